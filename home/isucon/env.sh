@@ -3,5 +3,11 @@ ISUBATA_DB_USER=isucon
 ISUBATA_DB_PASSWORD=isucon
 ISUBATA_SERVER_ID=01
 ISUBATA_OTHER_ID=02
+ISUBATA_SELF_HOST=app1
 ISUBATA_OTHER_HOST1=app2
 ISUBATA_OTHER_HOST2=app3
+# Secrets don't belong in git. ISUBATA_SESSION_KEYS and ISUBATA_SYNC_SECRET
+# go in secret.env next to this file, which is git-ignored and loaded as a
+# second EnvironmentFile. The sync secret has to be the same on every node:
+#   echo ISUBATA_SESSION_KEYS=$(openssl rand -hex 32) >> secret.env
+#   echo ISUBATA_SYNC_SECRET=$(openssl rand -hex 32) >> secret.env
@@ -0,0 +1,27 @@
+-- Schema changes the mysql store (ISUBATA_STORE=mysql) needs on top of the
+-- original isubata schema. Run once, after the original schema is loaded.
+
+-- edits and deletes (tombstones keep the row with deleted_at set)
+ALTER TABLE message ADD edited_at DATETIME NULL, ADD deleted_at DATETIME NULL;
+
+-- thread replies
+ALTER TABLE message ADD parent_id BIGINT NOT NULL DEFAULT 0, ADD INDEX (parent_id);
+
+-- "bcrypt$" and a bcrypt hash don't fit the 40 bytes of a SHA-1 hex digest
+ALTER TABLE user MODIFY password VARBINARY(128) NOT NULL;
+
+CREATE TABLE IF NOT EXISTS mention (
+	message_id BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	channel_id BIGINT NOT NULL,
+	PRIMARY KEY (user_id, message_id),
+	INDEX (user_id, channel_id, message_id),
+	INDEX (message_id)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS reaction (
+	message_id BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	emoji VARCHAR(64) NOT NULL,
+	PRIMARY KEY (message_id, emoji, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
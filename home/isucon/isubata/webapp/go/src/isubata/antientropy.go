@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const digestBucketSize = 1024
+
+// idDigest summarizes a set of versioned entities. Buckets maps
+// id/digestBucketSize to the xor of the hashes of the entities in it, so two
+// nodes only need to exchange the buckets that differ. An entity hashes its
+// version along with its ID, so a bucket also differs when one side missed an
+// edit, a profile update or a delete.
+type idDigest struct {
+	Count   int              `json:"count"`
+	MaxID   int64            `json:"max_id"`
+	Buckets map[int64]uint64 `json:"buckets"`
+}
+
+// clusterDigest is what /sync/digest returns. Reactions are bucketed by
+// message ID; HaveRead holds one hash per channel.
+type clusterDigest struct {
+	Users     idDigest           `json:"users"`
+	Channels  idDigest           `json:"channels"`
+	Messages  map[int64]idDigest `json:"messages"`
+	Reactions idDigest           `json:"reactions"`
+	HaveRead  map[int64]uint64   `json:"have_read"`
+}
+
+type digestHash struct {
+	h hash.Hash64
+}
+
+func newDigestHash() digestHash {
+	return digestHash{fnv.New64a()}
+}
+
+func (h digestHash) int(v int64) digestHash {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	h.h.Write(b[:])
+	return h
+}
+
+func (h digestHash) str(v string) digestHash {
+	h.int(int64(len(v)))
+	io.WriteString(h.h, v)
+	return h
+}
+
+func (h digestHash) time(t *time.Time) digestHash {
+	if t == nil || t.IsZero() {
+		return h.int(0)
+	}
+	return h.int(t.UnixNano())
+}
+
+func (h digestHash) sum() uint64 {
+	return h.h.Sum64()
+}
+
+func hashID(id int64) uint64 {
+	return newDigestHash().int(id).sum()
+}
+
+// hashUser covers everything a profile update, rename or password change
+// touches.
+func hashUser(u *User) uint64 {
+	return newDigestHash().int(u.ID).str(u.Name).str(u.Salt).str(u.Password).
+		str(u.DisplayName).str(u.AvatarIcon).time(&u.UpdatedAt).sum()
+}
+
+// hashMessage covers the version of m: a tombstone, or when it was last
+// edited.
+func hashMessage(m *Message) uint64 {
+	h := newDigestHash().int(m.ID)
+	if m.Deleted() {
+		return h.str("deleted").sum()
+	}
+	return h.time(m.EditedAt).sum()
+}
+
+func hashReaction(messageID, userID int64, emoji string) uint64 {
+	return newDigestHash().int(messageID).int(userID).str(emoji).sum()
+}
+
+func hashReactions(messageID int64, rs MessageReactions) uint64 {
+	var res uint64
+	for e, us := range rs {
+		for _, u := range us {
+			res ^= hashReaction(messageID, u, e)
+		}
+	}
+	return res
+}
+
+func hashHaveRead(userID, messageID int64) uint64 {
+	return newDigestHash().int(userID).int(messageID).sum()
+}
+
+func haveReadDigest(ch *Channel) uint64 {
+	var res uint64
+	for u, m := range ch.HaveRead.Hash() {
+		res ^= hashHaveRead(u, m)
+	}
+	return res
+}
+
+func newIDDigest() idDigest {
+	return idDigest{Buckets: make(map[int64]uint64)}
+}
+
+func (d *idDigest) add(id int64) {
+	d.addHash(id, hashID(id))
+}
+
+func (d *idDigest) addHash(id int64, h uint64) {
+	d.Count++
+	if id > d.MaxID {
+		d.MaxID = id
+	}
+	d.toggle(id, h)
+}
+
+// toggle adds h to the bucket of id, or takes it back out.
+func (d *idDigest) toggle(id int64, h uint64) {
+	b := id / digestBucketSize
+	if d.Buckets[b] ^= h; d.Buckets[b] == 0 {
+		delete(d.Buckets, b)
+	}
+}
+
+func (d idDigest) clone() idDigest {
+	res := d
+	res.Buckets = make(map[int64]uint64, len(d.Buckets))
+	for b, h := range d.Buckets {
+		res.Buckets[b] = h
+	}
+	return res
+}
+
+func newClusterDigest() clusterDigest {
+	return clusterDigest{
+		Users:     newIDDigest(),
+		Channels:  newIDDigest(),
+		Messages:  make(map[int64]idDigest),
+		Reactions: newIDDigest(),
+		HaveRead:  make(map[int64]uint64),
+	}
+}
+
+// digestCache keeps the clusterDigest of a memory store up to date as it
+// changes, so a digest doesn't need a walk over every message. HaveRead is
+// left out; it is cheap to hash when asked for.
+type digestCache struct {
+	d clusterDigest
+	m sync.Mutex
+}
+
+func newDigestCache() *digestCache {
+	c := &digestCache{}
+	c.reset()
+	return c
+}
+
+func (c *digestCache) reset() {
+	c.m.Lock()
+	c.d = newClusterDigest()
+	c.m.Unlock()
+}
+
+func (c *digestCache) addUser(u *User) {
+	c.m.Lock()
+	c.d.Users.addHash(u.ID, hashUser(u))
+	c.m.Unlock()
+}
+
+func (c *digestCache) replaceUser(old, u *User) {
+	c.m.Lock()
+	c.d.Users.toggle(u.ID, hashUser(old)^hashUser(u))
+	c.m.Unlock()
+}
+
+func (c *digestCache) addChannel(id int64) {
+	c.m.Lock()
+	c.d.Channels.add(id)
+	if _, ok := c.d.Messages[id]; !ok {
+		c.d.Messages[id] = newIDDigest()
+	}
+	c.m.Unlock()
+}
+
+func (c *digestCache) addMessage(m *Message) {
+	c.m.Lock()
+	md, ok := c.d.Messages[m.ChannelID]
+	if !ok {
+		md = newIDDigest()
+	}
+	md.addHash(m.ID, hashMessage(m))
+	c.d.Messages[m.ChannelID] = md
+	c.m.Unlock()
+}
+
+// replaceMessage swaps the version old of a message for m, an edit or a
+// tombstone.
+func (c *digestCache) replaceMessage(old, m *Message) {
+	c.m.Lock()
+	if md, ok := c.d.Messages[m.ChannelID]; ok {
+		md.toggle(m.ID, hashMessage(old)^hashMessage(m))
+	}
+	c.m.Unlock()
+}
+
+// toggleReaction adds a reaction that is new or takes out one that is gone.
+func (c *digestCache) toggleReaction(messageID, userID int64, emoji string) {
+	c.m.Lock()
+	c.d.Reactions.toggle(messageID, hashReaction(messageID, userID, emoji))
+	c.m.Unlock()
+}
+
+func (c *digestCache) get() *clusterDigest {
+	c.m.Lock()
+	defer c.m.Unlock()
+	res := newClusterDigest()
+	res.Users = c.d.Users.clone()
+	res.Channels = c.d.Channels.clone()
+	res.Reactions = c.d.Reactions.clone()
+	for id, md := range c.d.Messages {
+		res.Messages[id] = md.clone()
+	}
+	return &res
+}
+
+// diff returns the buckets that differ between d and other, on either side.
+func (d idDigest) diff(other idDigest) []int64 {
+	res := make([]int64, 0)
+	for b, h := range other.Buckets {
+		if d.Buckets[b] != h {
+			res = append(res, b)
+		}
+	}
+	for b := range d.Buckets {
+		if _, ok := other.Buckets[b]; !ok {
+			res = append(res, b)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// clusterDigest returns the digest of s from its cache.
+func (s *memoryStore) clusterDigest() *clusterDigest {
+	d := s.digest.get()
+	s.channels.Range(func(id int64, ch *Channel) bool {
+		d.HaveRead[id] = haveReadDigest(ch)
+		return true
+	})
+	return d
+}
+
+// dumpDigest builds the digest of a dump from scratch.
+func dumpDigest(dump *Dump) *clusterDigest {
+	res := newClusterDigest()
+	for id, u := range dump.Users {
+		res.Users.addHash(id, hashUser(u))
+	}
+	for id, ch := range dump.Channels {
+		res.Channels.add(id)
+		res.Messages[id] = newIDDigest()
+		res.HaveRead[id] = haveReadDigest(ch)
+	}
+	for id, m := range dump.Messages {
+		md, ok := res.Messages[m.ChannelID]
+		if !ok {
+			md = newIDDigest()
+		}
+		md.addHash(id, hashMessage(m))
+		res.Messages[m.ChannelID] = md
+	}
+	for id, rs := range dump.Reactions {
+		res.Reactions.toggle(id, hashReactions(id, rs))
+	}
+	return &res
+}
+
+// localDigest returns the digest of this node, from the memory store's cache
+// if there is one.
+func localDigest() (*clusterDigest, error) {
+	if memStore != nil {
+		return memStore.clusterDigest(), nil
+	}
+	d, err := store.Dump()
+	if err != nil {
+		return nil, err
+	}
+	return dumpDigest(d), nil
+}
+
+func getSyncDigest(c echo.Context) error {
+	d, err := localDigest()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+func bucketRange(c echo.Context) (int64, int64, error) {
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return 0, 0, ErrBadReqeust
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil || to-from > digestBucketSize {
+		return 0, 0, ErrBadReqeust
+	}
+	return from, to, nil
+}
+
+func getSyncUsers(c echo.Context) error {
+	from, to, err := bucketRange(c)
+	if err != nil {
+		return err
+	}
+	res := make([]*User, 0)
+	for id := from; id < to; id++ {
+		u, err := store.GetUser(id)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			res = append(res, u)
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func getSyncChannels(c echo.Context) error {
+	chs, err := store.ListChannels()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, chs)
+}
+
+func getSyncMessages(c echo.Context) error {
+	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	from, to, err := bucketRange(c)
+	if err != nil {
+		return err
+	}
+	// tombstones too, or a delete this peer missed would never reach it
+	ms, err := store.GetMessageRange(chanID, from, to)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ms)
+}
+
+// syncReactions are the reactions of one message and when they last changed.
+type syncReactions struct {
+	MessageID int64            `json:"message_id"`
+	Reactions MessageReactions `json:"reactions"`
+	At        time.Time        `json:"at"`
+}
+
+// localReactions returns the reactions of the messages with IDs in
+// [from, to), including the ones that had all of theirs taken back.
+func localReactions(from, to int64) (map[int64]*syncReactions, error) {
+	res := make(map[int64]*syncReactions)
+	for id := from; id < to; id++ {
+		var rs MessageReactions
+		var at time.Time
+		if memStore != nil {
+			rs, at = memStore.reactions.Version(id)
+		} else {
+			var err error
+			if rs, err = store.GetReactions(id); err != nil {
+				return nil, err
+			}
+		}
+		if len(rs) > 0 || !at.IsZero() {
+			res[id] = &syncReactions{id, rs, at}
+		}
+	}
+	return res, nil
+}
+
+func getSyncReactions(c echo.Context) error {
+	from, to, err := bucketRange(c)
+	if err != nil {
+		return err
+	}
+	rs, err := localReactions(from, to)
+	if err != nil {
+		return err
+	}
+	res := make([]*syncReactions, 0, len(rs))
+	for _, r := range rs {
+		res = append(res, r)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func getSyncHaveRead(c echo.Context) error {
+	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	ch, err := store.GetChannel(chanID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	return c.JSON(http.StatusOK, ch.HaveRead.Hash())
+}
+
+func getPeerJSON(host, path string, q url.Values, v interface{}) error {
+	u := "http://" + host + path
+	if q != nil {
+		u += "?" + q.Encode()
+	}
+	req, err := newSyncRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func bucketQuery(b int64) url.Values {
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(b*digestBucketSize, 10))
+	q.Set("to", strconv.FormatInt((b+1)*digestBucketSize, 10))
+	return q
+}
+
+type reconcileResult struct {
+	Users, Channels, Messages, Reactions, HaveRead int
+}
+
+// newerUser tells whether u should replace cur: it was updated later, or at
+// the same time and wins on its hash, so every node picks the same copy.
+func newerUser(u, cur *User) bool {
+	if !u.UpdatedAt.Equal(cur.UpdatedAt) {
+		return u.UpdatedAt.After(cur.UpdatedAt)
+	}
+	return hashUser(u) > hashUser(cur)
+}
+
+// newerMessage tells whether m is a later version of cur. A tombstone beats
+// any edit, and an edit the one before it.
+func newerMessage(m, cur *Message) bool {
+	if cur.Deleted() {
+		return false
+	}
+	if m.Deleted() {
+		return true
+	}
+	return m.EditedAt != nil && (cur.EditedAt == nil || m.EditedAt.After(*cur.EditedAt))
+}
+
+// newerReactions tells whether the reactions r should replace cur. Reactions
+// carry no per-user history, so the set changed last wins as a whole.
+func newerReactions(r, cur *syncReactions) bool {
+	if !r.At.Equal(cur.At) {
+		return r.At.After(cur.At)
+	}
+	return hashReactions(r.MessageID, r.Reactions) > hashReactions(cur.MessageID, cur.Reactions)
+}
+
+// setReactions turns the reactions of a message from cur into want, one
+// reaction at a time so that the WAL and the snapshot see every change.
+func setReactions(messageID int64, cur, want MessageReactions) error {
+	has := func(rs MessageReactions, emoji string, userID int64) bool {
+		for _, u := range rs[emoji] {
+			if u == userID {
+				return true
+			}
+		}
+		return false
+	}
+	for e, us := range want {
+		for _, u := range us {
+			if !has(cur, e, u) {
+				if err := store.AddReaction(messageID, u, e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for e, us := range cur {
+		for _, u := range us {
+			if !has(want, e, u) {
+				if err := store.RemoveReaction(messageID, u, e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reconcile pulls everything host has that this node is missing or holds an
+// older version of. Have-read marks only ever move forward here.
+func reconcile(host string) (reconcileResult, error) {
+	res := reconcileResult{}
+	remote := &clusterDigest{}
+	if err := getPeerJSON(host, "/sync/digest", nil, remote); err != nil {
+		return res, err
+	}
+	local, err := localDigest()
+	if err != nil {
+		return res, err
+	}
+
+	for _, b := range local.Users.diff(remote.Users) {
+		us := make([]*User, 0)
+		if err := getPeerJSON(host, "/sync/users", bucketQuery(b), &us); err != nil {
+			return res, err
+		}
+		for _, u := range us {
+			cur, err := store.GetUser(u.ID)
+			if err != nil {
+				return res, err
+			}
+			if cur != nil && !newerUser(u, cur) {
+				continue
+			}
+			if err := store.PutUser(u); err != nil {
+				return res, err
+			}
+			res.Users++
+		}
+	}
+
+	if len(local.Channels.diff(remote.Channels)) > 0 {
+		chs := make([]*Channel, 0)
+		if err := getPeerJSON(host, "/sync/channels", nil, &chs); err != nil {
+			return res, err
+		}
+		for _, ch := range chs {
+			if _, ok := local.Messages[ch.ID]; ok {
+				continue
+			}
+			if err := store.PutChannel(ch); err != nil {
+				return res, err
+			}
+			local.Messages[ch.ID] = newIDDigest()
+			res.Channels++
+		}
+	}
+
+	for chID, rd := range remote.Messages {
+		ld, ok := local.Messages[chID]
+		if !ok {
+			continue
+		}
+		for _, b := range ld.diff(rd) {
+			q := bucketQuery(b)
+			q.Set("channel_id", strconv.FormatInt(chID, 10))
+			ms := make([]*Message, 0)
+			if err := getPeerJSON(host, "/sync/messages", q, &ms); err != nil {
+				return res, err
+			}
+			for _, m := range ms {
+				cur, err := store.GetMessage(m.ID)
+				if err != nil {
+					return res, err
+				}
+				m.User = nil
+				switch {
+				case cur == nil:
+					err = store.AddMessage(m)
+				case !newerMessage(m, cur):
+					continue
+				case m.Deleted():
+					err = store.DeleteMessage(m)
+				default:
+					err = store.EditMessage(m)
+				}
+				if err != nil {
+					return res, err
+				}
+				res.Messages++
+			}
+		}
+	}
+
+	for _, b := range local.Reactions.diff(remote.Reactions) {
+		rs := make([]*syncReactions, 0)
+		if err := getPeerJSON(host, "/sync/reactions", bucketQuery(b), &rs); err != nil {
+			return res, err
+		}
+		mine, err := localReactions(b*digestBucketSize, (b+1)*digestBucketSize)
+		if err != nil {
+			return res, err
+		}
+		for _, r := range rs {
+			cur := mine[r.MessageID]
+			if cur == nil {
+				cur = &syncReactions{MessageID: r.MessageID}
+			}
+			if hashReactions(r.MessageID, r.Reactions) == hashReactions(cur.MessageID, cur.Reactions) || !newerReactions(r, cur) {
+				continue
+			}
+			if err := setReactions(r.MessageID, cur.Reactions, r.Reactions); err != nil {
+				return res, err
+			}
+			res.Reactions++
+		}
+	}
+
+	for chID, h := range remote.HaveRead {
+		if lh, ok := local.HaveRead[chID]; !ok || lh == h {
+			continue
+		}
+		q := url.Values{}
+		q.Set("channel_id", strconv.FormatInt(chID, 10))
+		hr := make(map[int64]int64)
+		if err := getPeerJSON(host, "/sync/haveread", q, &hr); err != nil {
+			return res, err
+		}
+		for userID, messageID := range hr {
+			cur, err := store.GetHaveRead(chID, userID)
+			if err != nil {
+				return res, err
+			}
+			if cur >= messageID {
+				continue
+			}
+			if err := store.UpdateHaveRead(chID, userID, messageID); err != nil {
+				return res, err
+			}
+			res.HaveRead++
+		}
+	}
+	return res, nil
+}
+
+func antiEntropyLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, p := range cluster.Peers() {
+			r, err := reconcile(p.host)
+			if err != nil {
+				log.Printf("anti-entropy: %s: %v", p.host, err)
+				continue
+			}
+			if r.Users+r.Channels+r.Messages+r.Reactions+r.HaveRead > 0 {
+				log.Printf("anti-entropy: pulled %d users, %d channels, %d messages, %d reactions, %d read marks from %s",
+					r.Users, r.Channels, r.Messages, r.Reactions, r.HaveRead, p.host)
+			}
+		}
+		resolveDuplicateNames()
+	}
+}
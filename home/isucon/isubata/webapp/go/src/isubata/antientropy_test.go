@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func checkDigest(t *testing.T, s *memoryStore) *clusterDigest {
+	t.Helper()
+	got := s.clusterDigest()
+	d, err := s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dumpDigest(d); !reflect.DeepEqual(got, want) {
+		t.Fatalf("cached digest differs from one built from a dump:\n got %+v\nwant %+v", got, want)
+	}
+	return got
+}
+
+func TestDigestCache(t *testing.T) {
+	now := time.Now()
+	s := newMemoryStore()
+	s.PutUser(&User{ID: 1, Name: "alice"})
+	s.PutUser(&User{ID: 2, Name: "bob"})
+	s.PutUser(&User{ID: 2, Name: "bob", DisplayName: "Bob", UpdatedAt: now})
+	s.PutChannel(&Channel{ID: 1, CreatedAt: now})
+	s.PutChannel(&Channel{ID: 2, CreatedAt: now})
+	s.PutChannel(&Channel{ID: 1, Name: "renamed", CreatedAt: now})
+	for id := int64(1); id <= 3000; id++ {
+		s.AddMessage(&Message{ID: id, ChannelID: id%2 + 1, UserID: 1, CreatedAt: now})
+	}
+	s.AddMessage(&Message{ID: 5, ChannelID: 2, UserID: 1, CreatedAt: now})
+	s.DeleteMessage(&Message{ID: 10, ChannelID: 1, DeletedAt: &now})
+	s.DeleteMessage(&Message{ID: 10, ChannelID: 1, DeletedAt: &now})
+	s.DeleteMessage(&Message{ID: 4000, ChannelID: 1, DeletedAt: &now})
+	s.EditMessage(&Message{ID: 12, ChannelID: 1, UserID: 1, Content: "edited", EditedAt: &now})
+	s.AddReaction(7, 1, "+1")
+	s.AddReaction(7, 2, "+1")
+	s.AddReaction(2000, 1, "tada")
+	s.RemoveReaction(7, 2, "+1")
+	s.UpdateHaveRead(1, 1, 100)
+	checkDigest(t, s)
+}
+
+func TestDigestDiff(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+	build := func() *memoryStore {
+		s := newMemoryStore()
+		s.PutUser(&User{ID: 1, Name: "alice"})
+		s.PutUser(&User{ID: 2, Name: "bob"})
+		s.PutChannel(&Channel{ID: 1, CreatedAt: now})
+		s.PutChannel(&Channel{ID: 2, CreatedAt: now})
+		for id := int64(1); id <= 3000; id++ {
+			s.AddMessage(&Message{ID: id, ChannelID: id%2 + 1, UserID: 1, CreatedAt: now})
+		}
+		s.AddReaction(7, 1, "+1")
+		s.UpdateHaveRead(1, 1, 100)
+		return s
+	}
+	base := checkDigest(t, build())
+
+	tests := []struct {
+		name   string
+		change func(s *memoryStore)
+		diff   func(local, other *clusterDigest) []int64
+		want   []int64
+	}{
+		{"tombstone", func(s *memoryStore) {
+			s.DeleteMessage(&Message{ID: 3001, ChannelID: 2, DeletedAt: &now})
+		}, func(l, o *clusterDigest) []int64 { return l.Messages[2].diff(o.Messages[2]) }, []int64{2}},
+		{"edit", func(s *memoryStore) {
+			s.EditMessage(&Message{ID: 1025, ChannelID: 2, UserID: 1, Content: "x", EditedAt: &later})
+		}, func(l, o *clusterDigest) []int64 { return l.Messages[2].diff(o.Messages[2]) }, []int64{1}},
+		{"profile", func(s *memoryStore) {
+			s.PutUser(&User{ID: 2, Name: "bob", DisplayName: "Bob", UpdatedAt: later})
+		}, func(l, o *clusterDigest) []int64 { return l.Users.diff(o.Users) }, []int64{0}},
+		{"reaction added", func(s *memoryStore) {
+			s.AddReaction(2048, 2, "tada")
+		}, func(l, o *clusterDigest) []int64 { return l.Reactions.diff(o.Reactions) }, []int64{2}},
+		{"reaction removed", func(s *memoryStore) {
+			s.RemoveReaction(7, 1, "+1")
+		}, func(l, o *clusterDigest) []int64 { return l.Reactions.diff(o.Reactions) }, []int64{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := build()
+			tt.change(s)
+			other := checkDigest(t, s)
+			if got := tt.diff(base, other); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diff = %v, want %v", got, tt.want)
+			}
+			if got := tt.diff(other, base); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diff the other way = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	s := build()
+	s.UpdateHaveRead(1, 1, 200)
+	if d := checkDigest(t, s); d.HaveRead[1] == base.HaveRead[1] || d.HaveRead[2] != base.HaveRead[2] {
+		t.Fatalf("have-read hashes = %v, base %v", d.HaveRead, base.HaveRead)
+	}
+}
+
+func TestNewerVersions(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+	live := &Message{ID: 1}
+	edited := &Message{ID: 1, EditedAt: &now}
+	editedLater := &Message{ID: 1, EditedAt: &later}
+	deleted := &Message{ID: 1, DeletedAt: &now}
+	for _, tt := range []struct {
+		name   string
+		m, cur *Message
+		want   bool
+	}{
+		{"edit over live", edited, live, true},
+		{"later edit", editedLater, edited, true},
+		{"earlier edit", edited, editedLater, false},
+		{"same edit", edited, edited, false},
+		{"live over edit", live, edited, false},
+		{"tombstone over edit", deleted, editedLater, true},
+		{"edit over tombstone", editedLater, deleted, false},
+	} {
+		if got := newerMessage(tt.m, tt.cur); got != tt.want {
+			t.Errorf("newerMessage %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	a := &User{ID: 1, Name: "alice", UpdatedAt: now}
+	b := &User{ID: 1, Name: "alice", DisplayName: "A", UpdatedAt: later}
+	if !newerUser(b, a) || newerUser(a, b) {
+		t.Errorf("the later profile update must win")
+	}
+	c := &User{ID: 1, Name: "alice", DisplayName: "C", UpdatedAt: later}
+	if newerUser(b, c) == newerUser(c, b) {
+		t.Errorf("a tie must be broken the same way on both sides")
+	}
+
+	r1 := &syncReactions{MessageID: 1, Reactions: MessageReactions{"+1": {1}}, At: now}
+	r2 := &syncReactions{MessageID: 1, Reactions: MessageReactions{}, At: later}
+	if !newerReactions(r2, r1) || newerReactions(r1, r2) {
+		t.Errorf("the reactions changed last must win")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	apiDefaultLimit = 50
+	apiMaxLimit     = 100
+)
+
+func queryInt64(c echo.Context, name string) (int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrBadReqeust
+	}
+	return n, nil
+}
+
+// getAPIMessages serves GET /api/channels/:channel_id/messages. Without
+// cursors it returns the newest messages; before pages toward older ones and
+// after toward newer ones. Items are oldest first, like /message, and
+// prev_cursor/next_cursor are the before/after values for the adjacent pages,
+// or null at either end.
+func getAPIMessages(c echo.Context) error {
+	if sessUserID(c) == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chanID <= 0 {
+		return ErrBadReqeust
+	}
+	before, err := queryInt64(c, "before")
+	if err != nil {
+		return err
+	}
+	after, err := queryInt64(c, "after")
+	if err != nil {
+		return err
+	}
+	limit := int64(apiDefaultLimit)
+	if c.QueryParam("limit") != "" {
+		limit, err = queryInt64(c, "limit")
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return ErrBadReqeust
+		}
+	}
+
+	ch, err := store.GetChannel(chanID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	p, err := store.GetMessagePage(chanID, after, before, int(limit))
+	if err != nil {
+		return err
+	}
+
+	items := make([]map[string]interface{}, 0, len(p.Messages))
+	for _, m := range p.Messages {
+		r, err := jsonifyMessage(m)
+		if err != nil {
+			return err
+		}
+		items = append(items, r)
+	}
+
+	var prev, next interface{}
+	if len(p.Messages) > 0 {
+		if p.HasOlder {
+			prev = p.Messages[0].ID
+		}
+		if p.HasNewer {
+			next = p.Messages[len(p.Messages)-1].ID
+		}
+	} else {
+		if p.HasOlder && after > 0 {
+			prev = after + 1
+		}
+		if p.HasNewer && before > 0 {
+			next = before - 1
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"channel_id":  chanID,
+		"messages":    items,
+		"prev_cursor": prev,
+		"next_cursor": next,
+	})
+}
@@ -3,16 +3,11 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
-	crand "crypto/rand"
-	"crypto/sha1"
-	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
@@ -22,28 +17,32 @@ import (
 
 	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/middleware"
-	"github.com/parnurzeal/gorequest"
 )
 
 const (
 	avatarMaxBytes = 1 * 1024 * 1024
+
+	// catchUpLimit caps how many messages a client is sent at once when it
+	// catches up on a channel; older ones can be paged back through the API.
+	catchUpLimit = 100
+
+	listenAddr = ":5000"
 )
 
 var (
-	db            *sqlx.DB
-	ErrBadReqeust = echo.NewHTTPError(http.StatusBadRequest)
-	redisClient   *redis.Client
-	other1        string
-	other2        string
-
-	users    map[int64]*User
-	channels Channels
-	messages Messages
+	db                 *sqlx.DB
+	ErrBadReqeust      = echo.NewHTTPError(http.StatusBadRequest)
+	ErrChannelNotFound = echo.NewHTTPError(http.StatusNotFound, "channel not found")
+	ErrMessageNotFound = echo.NewHTTPError(http.StatusNotFound, "message not found")
+	ErrNameTaken       = echo.NewHTTPError(http.StatusConflict, "name already taken")
+	redisClient        *redis.Client
+
+	store Store
+
+	fetchTimeout time.Duration
 )
 
 func min(a, b int64) int64 {
@@ -53,6 +52,14 @@ func min(a, b int64) int64 {
 	return b
 }
 
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
 type Renderer struct {
 	templates *template.Template
 }
@@ -61,16 +68,13 @@ func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
-func init() {
-	seedBuf := make([]byte, 8)
-	crand.Read(seedBuf)
-	rand.Seed(int64(binary.LittleEndian.Uint64(seedBuf)))
-	other1 = os.Getenv("ISUBATA_OTHER_HOST1")
-	other2 = os.Getenv("ISUBATA_OTHER_HOST2")
-
-	users = make(map[int64]*User)
-	channels = Channels{}
-	messages = Messages{}
+// setup connects to MySQL and Redis and builds the store. It is called from
+// main rather than being an init func so that tests don't need either.
+func setup() {
+	initCluster()
+	initSyncAuth()
+	initSessionKeys()
+	fetchTimeout = envDuration("ISUBATA_FETCH_TIMEOUT", 7*time.Second)
 
 	db_host := os.Getenv("ISUBATA_DB_HOST")
 	if db_host == "" {
@@ -103,103 +107,125 @@ func init() {
 		time.Sleep(time.Second * 3)
 	}
 
+	db.SetMaxOpenConns(20)
+	db.SetConnMaxLifetime(10 * time.Minute)
+	log.Printf("Succeeded to connect db.")
+
+	redisAddr := os.Getenv("ISUBATA_REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "app3:6379"
+	}
 	redisClient = redis.NewClient(&redis.Options{
-		Addr: "app3:6379",
+		Addr: redisAddr,
 	})
 
-	ub, err := redisClient.Get("users").Bytes()
-	if err != nil {
-		log.Fatal("failed to restore users: ", err)
-	}
-	if err := gob.NewDecoder(bytes.NewBuffer(ub)).Decode(&users); err != nil {
-		log.Fatal("failed to decode users: ", err)
+	go cluster.Join()
+
+	store = newStore()
+	ms, ok := store.(*memoryStore)
+	if !ok {
+		if mys, ok := store.(*mysqlStore); ok {
+			st, err := mys.Stats()
+			if err != nil {
+				log.Fatal(err)
+			}
+			seedCounters(st)
+		}
+		ss, err := newSearchStore(store)
+		if err != nil {
+			log.Fatal("failed to build search index: ", err)
+		}
+		store = ss
+		settleNames()
+		return
 	}
-	log.Println("restored users")
 
-	ch := make(map[int64]*Channel)
-	cb, err := redisClient.Get("channels").Bytes()
+	memStore = ms
+	src, epoch, err := bootMemoryStore(ms)
 	if err != nil {
-		log.Fatal("failed to restore channels: ", err)
-	}
-	if err := gob.NewDecoder(bytes.NewBuffer(cb)).Decode(&ch); err != nil {
-		log.Fatal("failed to decode channels: ", err)
+		log.Fatal(err)
 	}
-	for k, v := range ch {
-		channels.Store(k, v)
+
+	var cur Store = ms
+	var snap *snapshotStore
+	if os.Getenv("ISUBATA_SERVER_ID") == "03" {
+		snap = newSnapshotStore(ms)
+		// unless we booted from a per-entity snapshot, Redis may be missing
+		// entities that never change again, so write a full generation first
+		snap.full = src != "snapshot" || epoch == 0
+		cur = snap
 	}
-	log.Println("restored channels")
 
-	mh := make(map[int64]*Message)
-	mb, err := redisClient.Get("messages").Bytes()
+	walDir := os.Getenv("ISUBATA_WAL_DIR")
+	if walDir == "" {
+		walDir = "/home/isucon/isubata/wal"
+	}
+	j, err := openJournal(walDir)
 	if err != nil {
-		log.Fatal("failed to restore messages: ", err)
+		log.Fatal("failed to open wal: ", err)
 	}
-	if err := gob.NewDecoder(bytes.NewBuffer(mb)).Decode(&mh); err != nil {
-		log.Fatal("failed to decode messages: ", err)
+	n, err := j.Replay(cur)
+	if err != nil {
+		log.Fatal("failed to replay wal: ", err)
 	}
-	for k, v := range mh {
-		messages.Store(k, v)
+	log.Printf("replayed %d wal entries", n)
+	ms.reactions.ForgetVersions()
+	seedCounters(ms.Stats())
+	ss, err := newSearchStore(&walStore{Store: cur, j: j})
+	if err != nil {
+		log.Fatal("failed to build search index: ", err)
 	}
-	log.Println("restored messages")
+	store = ss
+	go j.compactLoop(cur, envDuration("ISUBATA_WAL_COMPACT_INTERVAL", 180*time.Second))
 
-	db.SetMaxOpenConns(20)
-	db.SetConnMaxLifetime(10 * time.Minute)
-	log.Printf("Succeeded to connect db.")
-
-	if os.Getenv("ISUBATA_SERVER_ID") == "03" {
-		go func() {
-			for {
-				time.Sleep(time.Second * 180)
-
-				userBuf := bytes.Buffer{}
-				userEnc := gob.NewEncoder(&userBuf)
-				if err := userEnc.Encode(users); err != nil {
-					log.Fatal("failed to save user:", err)
-				}
-				redisClient.Set("users", userBuf.Bytes(), 0)
-				log.Println("saved user")
-
-				channelBuf := bytes.Buffer{}
-				channelEnc := gob.NewEncoder(&channelBuf)
-				if err := channelEnc.Encode(channels.Hash()); err != nil {
-					log.Fatal("failed to save channel:", err)
-				}
-				redisClient.Set("channels", channelBuf.Bytes(), 0)
-				log.Println("saved channel")
-
-				messageBuf := bytes.Buffer{}
-				messageEnc := gob.NewEncoder(&messageBuf)
-				if err := messageEnc.Encode(messages.Hash()); err != nil {
-					log.Fatal("failed to save message:", err)
-				}
-				redisClient.Set("messages", messageBuf.Bytes(), 0)
-				log.Println("saved message")
-			}
-		}()
+	if snap != nil {
+		go snap.saveLoop(time.Second * 180)
 	}
+	settleNames()
+	go antiEntropyLoop(envDuration("ISUBATA_ANTI_ENTROPY_INTERVAL", 30*time.Second))
 }
 
-func getUser(userID int64) (*User, error) {
-	return users[userID], nil
-}
-
-func addMessage(channelID, userID int64, content string) (int64, error) {
+// addMessage posts a message. A non-zero parentID makes it a reply in the
+// thread of that message; replying to a reply joins the same thread.
+func addMessage(channelID, userID, parentID int64, content string) (int64, error) {
+	if parentID != 0 {
+		p, err := store.GetMessage(parentID)
+		if err != nil {
+			return 0, err
+		}
+		if p == nil || p.Deleted() || p.ChannelID != channelID {
+			return 0, ErrMessageNotFound
+		}
+		if p.ParentID != 0 {
+			parentID = p.ParentID
+		}
+	}
 	id, err := redisClient.Incr("message").Result()
 	if err != nil {
 		return 0, err
 	}
+	u, err := store.GetUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	mentions, err := parseMentions(content)
+	if err != nil {
+		return 0, err
+	}
 	m := &Message{
 		ID:        id,
 		ChannelID: channelID,
 		UserID:    userID,
 		Content:   content,
 		CreatedAt: time.Now(),
-		User:      users[userID],
+		ParentID:  parentID,
+		Mentions:  mentions,
+		User:      u,
+	}
+	if err := store.AddMessage(m); err != nil {
+		return 0, err
 	}
-	messages.Store(id, m)
-	channels.Load(channelID).AddMessage(m)
-	gorequest.New().Post("http://" + other1 + "/sync/message").Send(m).End()
-	gorequest.New().Post("http://" + other2 + "/sync/message").Send(m).End()
+	replicateMessage(m)
 	return id, nil
 }
 
@@ -215,31 +241,8 @@ type IMessage struct {
 	AvatarIcon  string `json:"avatar_icon" db:"avatar_icon"`
 }
 
-func queryMessages(chanID, lastID int64) []*Message {
-	m := channels.Load(chanID).GetMessagesAfter(lastID)
-	if len(m) > 100 {
-		m = m[len(m)-100:]
-	}
-	return m
-}
-
-func sessUserID(c echo.Context) int64 {
-	sess, _ := session.Get("session", c)
-	var userID int64
-	if x, ok := sess.Values["user_id"]; ok {
-		userID, _ = x.(int64)
-	}
-	return userID
-}
-
-func sessSetUserID(c echo.Context, id int64) {
-	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		HttpOnly: true,
-		MaxAge:   360000,
-	}
-	sess.Values["user_id"] = id
-	sess.Save(c.Request(), c.Response())
+func queryMessages(chanID, lastID int64, replies bool) ([]*Message, error) {
+	return store.GetMessagesAfter(chanID, lastID, catchUpLimit, replies)
 }
 
 func ensureLogin(c echo.Context) (*User, error) {
@@ -251,14 +254,12 @@ func ensureLogin(c echo.Context) (*User, error) {
 		goto redirect
 	}
 
-	user, err = getUser(userID)
+	user, err = store.GetUser(userID)
 	if err != nil {
 		return nil, err
 	}
 	if user == nil {
-		sess, _ := session.Get("session", c)
-		delete(sess.Values, "user_id")
-		sess.Save(c.Request(), c.Response())
+		sessClear(c)
 		goto redirect
 	}
 	return user, nil
@@ -268,34 +269,33 @@ redirect:
 	return nil, nil
 }
 
-const LettersAndDigits = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-func randomString(n int) string {
-	b := make([]byte, n)
-	z := len(LettersAndDigits)
-
-	for i := 0; i < n; i++ {
-		b[i] = LettersAndDigits[rand.Intn(z)]
-	}
-	return string(b)
-}
-
 func register(name, password string) (int64, error) {
 	id, err := redisClient.Incr("user").Result()
 	if err != nil {
 		return 0, err
 	}
-	salt := randomString(20)
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+	if err := reserveName(name, id); err != nil {
+		return 0, err
+	}
+	digest, err := hashPassword(password)
+	if err != nil {
+		releaseName(name, id)
+		return 0, err
+	}
 
-	users[id] = &User{
+	now := time.Now()
+	err = store.AddUser(&User{
 		ID:          id,
 		Name:        name,
-		Salt:        salt,
 		Password:    digest,
 		DisplayName: name,
 		AvatarIcon:  "default.png",
-		CreatedAt:   time.Now(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		releaseName(name, id)
+		return 0, err
 	}
 	return id, nil
 }
@@ -322,10 +322,20 @@ func getChannel(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	ch := channels.Load(int64(cID))
+	ch, err := store.GetChannel(int64(cID))
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	chs, err := store.ListChannels()
+	if err != nil {
+		return err
+	}
 	return c.Render(http.StatusOK, "channel", map[string]interface{}{
 		"ChannelID":   cID,
-		"Channels":    channels.Slice(),
+		"Channels":    chs,
 		"User":        user,
 		"Description": ch.Description,
 	})
@@ -345,14 +355,23 @@ func postRegister(c echo.Context) error {
 	if name == "" || pw == "" {
 		return ErrBadReqeust
 	}
-	for _, u := range users {
-		if u.Name == name {
-			return c.NoContent(http.StatusConflict)
-		}
+	if u, err := store.GetUserByName(name); err != nil {
+		return err
+	} else if u != nil {
+		return c.NoContent(http.StatusConflict)
+	}
+	userID, err := register(name, pw)
+	if err == ErrNameTaken {
+		return c.NoContent(http.StatusConflict)
+	}
+	if err != nil {
+		return err
 	}
-	userID, _ := register(name, pw)
-	gorequest.New().Post("http://" + other1 + "/sync/register").Send(users[userID]).End()
-	gorequest.New().Post("http://" + other2 + "/sync/register").Send(users[userID]).End()
+	u, err := store.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	replicateUser(u)
 	sessSetUserID(c, userID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
@@ -372,29 +391,37 @@ func postLogin(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	var user *User
-	for _, u := range users {
-		if u.Name == name {
-			user = u
-			break
-		}
+	limits := loginLimits(c, name)
+	wait, err := loginAttempt(c, limits)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return loginTooMany(c, wait)
+	}
+
+	user, err := store.GetUserByName(name)
+	if err != nil {
+		return err
 	}
 	if user == nil {
 		return echo.ErrForbidden
 	}
 
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
-	if digest != user.Password {
+	ok, rehash := checkPassword(user, pw)
+	if !ok {
 		return echo.ErrForbidden
 	}
+	loginSucceeded(limits)
+	if rehash {
+		rehashPassword(user, pw)
+	}
 	sessSetUserID(c, user.ID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
 func getLogout(c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+	sessClear(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -416,7 +443,14 @@ func postMessage(c echo.Context) error {
 		chanID = int64(x)
 	}
 
-	_, err = addMessage(chanID, user.ID, message)
+	var parentID int64
+	if v := c.FormValue("parent_id"); v != "" {
+		if parentID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return echo.ErrForbidden
+		}
+	}
+
+	_, err = addMessage(chanID, user.ID, parentID, message)
 	if err != nil {
 		return err
 	}
@@ -424,8 +458,11 @@ func postMessage(c echo.Context) error {
 }
 
 func jsonifyMessage(m *Message) (map[string]interface{}, error) {
-	u, ok := users[m.UserID]
-	if !ok {
+	u, err := store.GetUser(m.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
 		return nil, fmt.Errorf("nil user: %d of %+v", m.UserID, m)
 	}
 
@@ -442,6 +479,31 @@ func jsonifyMessage(m *Message) (map[string]interface{}, error) {
 	}
 	r["date"] = m.CreatedAt.Format("2006/01/02 15:04:05")
 	r["content"] = m.Content
+	if m.EditedAt != nil {
+		r["edited_at"] = m.EditedAt.Format("2006/01/02 15:04:05")
+	}
+	if len(m.Mentions) > 0 {
+		names := make([]string, 0, len(m.Mentions))
+		for _, id := range m.Mentions {
+			mu, err := store.GetUser(id)
+			if err != nil {
+				return nil, err
+			}
+			if mu != nil {
+				names = append(names, mu.Name)
+			}
+		}
+		r["mentions"] = names
+	}
+	if m.ParentID != 0 {
+		r["parent_id"] = m.ParentID
+	} else {
+		cnt, err := store.CountReplies(m.ChannelID, m.ID)
+		if err != nil {
+			return nil, err
+		}
+		r["reply_count"] = cnt
+	}
 	return r, nil
 }
 
@@ -460,7 +522,11 @@ func getMessage(c echo.Context) error {
 		return err
 	}
 
-	ms := queryMessages(chanID, lastID)
+	replies := c.QueryParam("include_replies") == "1"
+	ms, err := queryMessages(chanID, lastID, replies)
+	if err != nil {
+		return err
+	}
 
 	response := make([]map[string]interface{}, 0)
 	//for i := len(messages) - 1; i >= 0; i-- {
@@ -474,24 +540,31 @@ func getMessage(c echo.Context) error {
 		if err != nil {
 			return err
 		}
+		if r["reactions"], err = jsonifyReactions(m.ID, userID); err != nil {
+			return err
+		}
 		response = append(response, r)
 	}
 
 	if len(ms) > 0 {
-		channels.Load(chanID).UpdateHaveRead(userID, ms[len(ms)-1].ID)
-		gorequest.New().Get(fmt.Sprintf("http://%s/sync/haveread/%d/%d/%d", other1, chanID, userID, ms[len(ms)-1].ID)).End()
-		gorequest.New().Get(fmt.Sprintf("http://%s/sync/haveread/%d/%d/%d", other2, chanID, userID, ms[len(ms)-1].ID)).End()
+		if err := store.UpdateHaveRead(chanID, userID, ms[len(ms)-1].ID); err != nil {
+			return err
+		}
+		replicateHaveRead(chanID, userID, ms[len(ms)-1].ID)
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
 func queryChannels() ([]int64, error) {
-	res := make([]int64, 0)
-	channels.Range(func(id int64, _ *Channel) bool {
-		res = append(res, id)
-		return true
-	})
+	chs, err := store.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int64, 0, len(chs))
+	for _, ch := range chs {
+		res = append(res, ch.ID)
+	}
 	return res, nil
 }
 
@@ -501,29 +574,54 @@ func fetchUnread(c echo.Context) error {
 		return c.NoContent(http.StatusForbidden)
 	}
 
-	time.Sleep(time.Millisecond * 7000)
+	wait := unreadNotifier.Wait(userID)
+	resp, total, err := queryUnread(userID)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		t := time.NewTimer(fetchTimeout)
+		select {
+		case <-wait:
+		case <-t.C:
+		case <-c.Request().Context().Done():
+		}
+		t.Stop()
+		resp, _, err = queryUnread(userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
 
+func queryUnread(userID int64) ([]map[string]interface{}, int64, error) {
 	resp := []map[string]interface{}{}
+	var total int64
 
-	channels.Range(func(chID int64, ch *Channel) bool {
-		lastID := ch.GetHaveRead(userID)
-		var cnt int64
-		ch.m.RLock()
-		for _, m := range ch.Messages {
-			if m.ID > lastID {
-				cnt++
-			}
+	chIDs, err := queryChannels()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, chID := range chIDs {
+		cnt, err := store.CountUnread(chID, userID)
+		if err != nil {
+			return nil, 0, err
+		}
+		total += cnt
+		mcnt, err := store.CountUnreadMentions(chID, userID)
+		if err != nil {
+			return nil, 0, err
 		}
-		ch.m.RUnlock()
 		r := map[string]interface{}{
 			"channel_id": chID,
 			"unread":     cnt,
+			"mentions":   mcnt,
 		}
 		resp = append(resp, r)
-		return true
-	})
-
-	return c.JSON(http.StatusOK, resp)
+	}
+	return resp, total, nil
 }
 
 func getHistory(c echo.Context) error {
@@ -549,11 +647,10 @@ func getHistory(c echo.Context) error {
 	}
 
 	const N = 20
-	ch := channels.Load(int64(chID))
-	ch.m.RLock()
-	ms := ch.Messages[:]
-	ch.m.RUnlock()
-	cnt := int64(len(ms))
+	cnt, err := store.CountMessages(chID)
+	if err != nil {
+		return err
+	}
 	maxPage := int64(cnt+N-1) / N
 	if maxPage == 0 {
 		maxPage = 1
@@ -562,30 +659,30 @@ func getHistory(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	rev := make([]*Message, len(ms))
-	for i, m := range ms {
-		rev[len(ms)-i-1] = m
-	}
-	msgs := rev[:]
-	begin := min((page-1)*N, int64(len(ms)))
-	end := min(page*N, int64(len(ms)))
-	if end > 0 {
-		fmt.Println("page: ", len(ms), begin, end)
-		msgs = rev[begin:end]
+	msgs, err := store.GetLatestMessages(chID, int((page-1)*N), N)
+	if err != nil {
+		return err
 	}
 
 	mjson := make([]map[string]interface{}, 0)
-	for i := len(msgs) - 1; i >= 0; i-- {
-		r, err := jsonifyMessage(msgs[i])
+	for _, m := range msgs {
+		r, err := jsonifyMessage(m)
 		if err != nil {
 			return err
 		}
+		if r["reactions"], err = jsonifyReactions(m.ID, user.ID); err != nil {
+			return err
+		}
 		mjson = append(mjson, r)
 	}
 
+	chs, err := store.ListChannels()
+	if err != nil {
+		return err
+	}
 	return c.Render(http.StatusOK, "history", map[string]interface{}{
 		"ChannelID": chID,
-		"Channels":  channels.Slice(),
+		"Channels":  chs,
 		"Messages":  mjson,
 		"MaxPage":   maxPage,
 		"Page":      page,
@@ -606,27 +703,34 @@ func getProfile(c echo.Context) error {
 	//}
 
 	userName := c.Param("user_name")
-	var other *User
-	for _, u := range users {
-		if u.Name == userName {
-			other = u
-		}
-	}
+	other, err := store.GetUserByName(userName)
 	//err = db.Get(&other, "SELECT * FROM user WHERE name = ?", userName)
 	//if err == sql.ErrNoRows {
+	if err != nil {
+		return err
+	}
 	if other == nil {
 		return echo.ErrNotFound
 	}
+
+	chs, err := store.ListChannels()
 	if err != nil {
 		return err
 	}
-
+	var sessions []*sessionInfo
+	if self.ID == other.ID {
+		sessions, err = listSessions(self.ID)
+		if err != nil {
+			return err
+		}
+	}
 	return c.Render(http.StatusOK, "profile", map[string]interface{}{
 		"ChannelID":   0,
-		"Channels":    channels.Slice(),
+		"Channels":    chs,
 		"User":        self,
 		"Other":       other,
 		"SelfProfile": self.ID == other.ID,
+		"Sessions":    sessions,
 	})
 }
 
@@ -642,9 +746,13 @@ func getAddChannel(c echo.Context) error {
 	//	return err
 	//}
 
+	chs, err := store.ListChannels()
+	if err != nil {
+		return err
+	}
 	return c.Render(http.StatusOK, "add_channel", map[string]interface{}{
 		"ChannelID": 0,
-		"Channels":  channels.Slice(),
+		"Channels":  chs,
 		"User":      self,
 	})
 }
@@ -676,11 +784,11 @@ func postAddChannel(c echo.Context) error {
 		UpdatedAt:   now,
 		CreatedAt:   now,
 		HaveRead:    HaveRead{},
-		Messages:    make([]*Message, 0),
 	}
-	channels.Store(lastID, ch)
-	gorequest.New().Post("http://" + other1 + "/sync/channel").Send(ch).End()
-	gorequest.New().Post("http://" + other2 + "/sync/channel").Send(ch).End()
+	if err := store.PutChannel(ch); err != nil {
+		return err
+	}
+	replicateChannel(ch)
 	//lastID, _ := res.LastInsertId()
 	return c.Redirect(http.StatusSeeOther,
 		fmt.Sprintf("/channel/%v", lastID))
@@ -719,6 +827,7 @@ func postProfile(c echo.Context) error {
 		return err
 	}
 
+	u := *self
 	avatarName := ""
 	var avatarData []byte
 
@@ -763,15 +872,18 @@ func postProfile(c echo.Context) error {
 			return err
 		}
 		ioutil.WriteFile("/home/isucon/isubata/webapp/public/icons/"+avatarName+".gz", avatarDataGzip, os.ModePerm)
-		users[self.ID].AvatarIcon = os.Getenv("ISUBATA_SERVER_ID") + "/" + avatarName
+		u.AvatarIcon = os.Getenv("ISUBATA_SERVER_ID") + "/" + avatarName
 	}
 
 	if name := c.FormValue("display_name"); name != "" {
-		users[self.ID].DisplayName = name
+		u.DisplayName = name
 	}
 
-	gorequest.New().Post("http://" + other1 + "/sync/profile").Send(users[self.ID]).End()
-	gorequest.New().Post("http://" + other2 + "/sync/profile").Send(users[self.ID]).End()
+	u.UpdatedAt = time.Now()
+	if err := store.PutUser(&u); err != nil {
+		return err
+	}
+	replicateUser(&u)
 
 	return c.Redirect(http.StatusSeeOther, "/")
 }
@@ -789,6 +901,8 @@ func tRange(a, b int64) []int64 {
 }
 
 func main() {
+	setup()
+
 	e := echo.New()
 	funcs := template.FuncMap{
 		"add":    tAdd,
@@ -797,7 +911,6 @@ func main() {
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secretonymoris"))))
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "request:\"${method} ${uri}\" status:${status} latency:${latency} (${latency_human}) bytes:${bytes_out}\n",
 	}))
@@ -810,12 +923,25 @@ func main() {
 	e.GET("/login", getLogin)
 	e.POST("/login", postLogin)
 	e.GET("/logout", getLogout)
+	e.POST("/logout_all", postLogoutAll)
+	e.GET("/sessions", getSessions)
+	e.DELETE("/sessions/:id", deleteSession)
 
 	e.GET("/channel/:channel_id", getChannel)
 	e.GET("/message", getMessage)
 	e.POST("/message", postMessage)
+	e.PUT("/message/:id", putMessage)
+	e.DELETE("/message/:id", deleteMessage)
+	e.GET("/message/:id/thread", getThread)
+	e.POST("/message/:id/reactions/:emoji", postReaction)
+	e.DELETE("/message/:id/reactions/:emoji", deleteReaction)
 	e.GET("/fetch", fetchUnread)
+	e.GET("/mentions", getMentions)
+	e.GET("/search", getSearch)
 	e.GET("/history/:channel_id", getHistory)
+	e.GET("/api/channels/:channel_id/messages", getAPIMessages)
+	e.GET("/stream/:channel_id", getStream)
+	e.GET("/ws", getWebSocket)
 
 	e.GET("/profile/:user_name", getProfile)
 	e.POST("/profile", postProfile)
@@ -823,14 +949,27 @@ func main() {
 	e.GET("add_channel", getAddChannel)
 	e.POST("add_channel", postAddChannel)
 
-	e.POST("/sync/register", syncRegister)
-	e.POST("/sync/message", syncMessage)
-	e.POST("/sync/profile", syncProfile)
-	e.POST("/sync/channel", syncAddChannel)
-	e.GET("/sync/haveread/:channel_id/:user_id/:message_id", syncHaveRead)
-	e.GET("/sync/initialize", syncInitialize)
+	s := e.Group("/sync", syncAuth)
+	s.POST("/register", syncRegister)
+	s.POST("/message", syncMessage)
+	s.POST("/profile", syncProfile)
+	s.POST("/channel", syncAddChannel)
+	s.GET("/haveread/:channel_id/:user_id/:message_id", syncHaveRead)
+	s.GET("/initialize", syncInitialize)
+	s.POST("/batch", syncBatch)
+	s.POST("/join", syncJoin)
+	s.POST("/leave", syncLeave)
+	s.GET("/digest", getSyncDigest)
+	s.GET("/users", getSyncUsers)
+	s.GET("/channels", getSyncChannels)
+	s.GET("/messages", getSyncMessages)
+	s.GET("/reactions", getSyncReactions)
+	s.GET("/haveread", getSyncHaveRead)
 
 	e.GET("/dump", dump)
+	e.GET("/replication", getReplicationStatus)
+	e.GET("/members", getMembers)
+	e.GET("/sync_auth", getSyncAuthStatus)
 
-	e.Start(":5000")
+	e.Start(listenAddr)
 }
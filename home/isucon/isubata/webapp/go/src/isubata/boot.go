@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+const defaultBootOrder = "snapshot,mysql,empty"
+
+// bootMemoryStore fills ms from the first source in ISUBATA_BOOT_ORDER that
+// loads without error. It returns the source used and, for a snapshot, its
+// epoch.
+func bootMemoryStore(ms *memoryStore) (string, int64, error) {
+	order := os.Getenv("ISUBATA_BOOT_ORDER")
+	if order == "" {
+		order = defaultBootOrder
+	}
+
+	for _, src := range strings.Split(order, ",") {
+		src = strings.TrimSpace(src)
+		var epoch int64
+		var err error
+		switch src {
+		case "snapshot":
+			epoch, err = restoreSnapshot(ms)
+		case "mysql":
+			err = ms.Reset()
+		case "empty":
+		default:
+			err = fmt.Errorf("unknown boot source %q", src)
+		}
+		if err != nil {
+			log.Printf("boot: %s unavailable: %v", src, err)
+			ms.clear()
+			continue
+		}
+
+		st := ms.Stats()
+		log.Printf("boot: loaded from %s: %d users, %d channels, %d messages",
+			src, st.Users, st.Channels, st.Messages)
+		return src, epoch, nil
+	}
+	return "", 0, fmt.Errorf("boot: no usable source in %q", order)
+}
+
+// seedCounters makes sure the Redis ID counters do not hand out IDs that are
+// already taken, e.g. after Redis was flushed. It has to run once the store
+// holds everything, WAL included. A counter behind the store is moved up with
+// INCRBY rather than SET, so IDs handed out meanwhile are not handed out again.
+func seedCounters(st storeStats) {
+	for key, id := range map[string]int64{
+		"user":    st.MaxUserID,
+		"channel": st.MaxChannelID,
+		"message": st.MaxMessageID,
+	} {
+		cur, err := redisClient.Get(key).Int64()
+		if err != nil && err != redis.Nil {
+			log.Printf("boot: failed to seed %s counter: %v", key, err)
+			continue
+		}
+		if cur >= id {
+			continue
+		}
+		if err := redisClient.IncrBy(key, id-cur).Err(); err != nil {
+			log.Printf("boot: failed to seed %s counter: %v", key, err)
+		}
+	}
+}
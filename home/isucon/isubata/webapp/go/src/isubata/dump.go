@@ -7,9 +7,9 @@ import (
 )
 
 func dump(c echo.Context) error {
-	return c.JSON(http.StatusOK, &Dump{
-		Users:    users,
-		Channels: channels.Hash(),
-		Messages: messages.Hash(),
-	})
+	d, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, d)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ownMessage loads the message named by :id and checks that the logged in
+// user wrote it.
+func ownMessage(c echo.Context) (*Message, error) {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return nil, echo.ErrForbidden
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return nil, ErrBadReqeust
+	}
+	m, err := store.GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || m.Deleted() {
+		return nil, ErrMessageNotFound
+	}
+	if m.UserID != userID {
+		return nil, echo.ErrForbidden
+	}
+	return m, nil
+}
+
+func putMessage(c echo.Context) error {
+	cur, err := ownMessage(c)
+	if err != nil {
+		return err
+	}
+	content := c.FormValue("message")
+	if content == "" {
+		return ErrBadReqeust
+	}
+
+	mentions, err := parseMentions(content)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m := *cur
+	m.Content = content
+	m.Mentions = mentions
+	m.EditedAt = &now
+	if err := store.EditMessage(&m); err != nil {
+		return err
+	}
+	replicateEditMessage(&m)
+
+	r, err := jsonifyMessage(&m)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+func deleteMessage(c echo.Context) error {
+	cur, err := ownMessage(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m := &Message{
+		ID:        cur.ID,
+		ChannelID: cur.ChannelID,
+		UserID:    cur.UserID,
+		CreatedAt: cur.CreatedAt,
+		ParentID:  cur.ParentID,
+		DeletedAt: &now,
+	}
+	if err := store.DeleteMessage(m); err != nil {
+		return err
+	}
+	replicateDeleteMessage(m)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"log"
+	"net/http"
+
 	"github.com/labstack/echo"
-	"github.com/parnurzeal/gorequest"
 )
 
 func getInitialize(c echo.Context) error {
@@ -17,54 +19,62 @@ func getInitialize(c echo.Context) error {
 	redisClient.Set("channel", 10, 0)
 	redisClient.Set("message", 10000, 0)
 
-	gorequest.New().Get("http://" + other1 + "/sync/initialize").End()
-	gorequest.New().Get("http://" + other2 + "/sync/initialize").End()
+	for _, p := range cluster.Peers() {
+		p.clear()
+		req, err := newSyncRequest(http.MethodGet, "http://"+p.host+"/sync/initialize", nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := syncClient.Do(req); err != nil {
+			log.Printf("failed to initialize %s: %v", p.host, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
 	return syncInitialize(c)
 }
 
 func syncInitialize(c echo.Context) error {
-	err := resetRedis()
+	err := store.Reset()
 	if err != nil {
 		return err
 	}
+	// the reservations went with the Redis flush
+	settleNames()
 
 	return c.String(204, "")
 }
 
-func resetRedis() error {
-	users = make(map[int64]*User)
-	channels = Channels{}
-	messages = Messages{}
-
-	if err := initializeUsers(); err != nil {
-		return err
-	}
-	if err := initializeChannels(); err != nil {
-		return err
-	}
-	if err := initializeMessages(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func initializeUsers() error {
+// initializeUsers loads the users into fresh maps and swaps them in, so
+// requests running alongside /initialize never see a half-built index.
+func (s *memoryStore) initializeUsers() error {
 	rows, err := db.Query("SELECT id, name, salt, password, display_name, avatar_icon, created_at FROM user")
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
+	fresh := &memoryStore{
+		users:  make(map[int64]*User),
+		byName: make(map[string]*User),
+		digest: s.digest,
+	}
 	for rows.Next() {
 		var u User
 		if err := rows.Scan(&u.ID, &u.Name, &u.Salt, &u.Password, &u.DisplayName, &u.AvatarIcon, &u.CreatedAt); err != nil {
 			return err
 		}
-		users[u.ID] = &u
+		fresh.putUser(&u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	s.m.Lock()
+	s.users, s.byName = fresh.users, fresh.byName
+	s.m.Unlock()
 	return nil
 }
 
-func initializeChannels() error {
+func (s *memoryStore) initializeChannels() error {
 	rows, err := db.Query("SELECT id, name, description, updated_at, created_at FROM channel")
 	if err != nil {
 		return err
@@ -75,12 +85,13 @@ func initializeChannels() error {
 		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.UpdatedAt, &c.CreatedAt); err != nil {
 			return err
 		}
-		channels.Store(c.ID, &c)
+		s.channels.Store(c.ID, &c)
+		s.digest.addChannel(c.ID)
 	}
 	return nil
 }
 
-func initializeMessages() error {
+func (s *memoryStore) initializeMessages() error {
 	rows, err := db.Query("SELECT id, channel_id, user_id, content, created_at FROM message")
 	if err != nil {
 		return err
@@ -91,11 +102,10 @@ func initializeMessages() error {
 		if err := rows.Scan(&m.ID, &m.ChannelID, &m.UserID, &m.Content, &m.CreatedAt); err != nil {
 			return err
 		}
-		m.User = users[m.UserID]
-		messages.Store(m.ID, &m)
-		ch := channels.Load(m.ChannelID)
-		ch.HaveRead = HaveRead{}
-		ch.Messages = append(ch.Messages, &m)
+		m.User, _ = s.GetUser(m.UserID)
+		s.messages.Store(m.ID, &m)
+		s.digest.addMessage(&m)
+		s.channels.Load(m.ChannelID).AddMessage(&m)
 	}
 	return nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Login attempts are counted per user name and per client IP in Redis, so
+// every app server sees the same counts. A counter is bumped before the
+// password is checked, so parallel guesses can't all slip in under the limit.
+// Past the limit, the name or IP gets one attempt per lockout, which starts
+// at loginLockBase and doubles each time, up to loginLockMax. A successful
+// login clears the counter of the name and takes its attempt back off the
+// IP, so guessing one account right doesn't buy more guesses at others.
+const (
+	loginUserLimit = 5
+	loginIPLimit   = 20
+	loginFailTTL   = 24 * time.Hour
+	loginLockBase  = time.Minute
+	loginLockMax   = time.Hour
+)
+
+// clientIP returns the address of the client. nginx, on the same host, sets
+// X-Real-IP; the header is ignored on requests from anywhere else, and
+// X-Forwarded-For is never trusted since clients can send it themselves.
+func clientIP(c echo.Context) string {
+	return requestIP(c.Request())
+}
+
+// requestIP is clientIP for a plain *http.Request.
+func requestIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if real := req.Header.Get("X-Real-IP"); real != "" {
+			return real
+		}
+	}
+	return host
+}
+
+type loginLimit struct {
+	scope string
+	key   string
+	limit int64
+}
+
+func loginLimits(c echo.Context, name string) []loginLimit {
+	return []loginLimit{
+		{"user", name, loginUserLimit},
+		{"ip", clientIP(c), loginIPLimit},
+	}
+}
+
+func (l loginLimit) failKey() string {
+	return "login:fail:" + l.scope + ":" + l.key
+}
+
+func (l loginLimit) lockKey() string {
+	return "login:lock:" + l.scope + ":" + l.key
+}
+
+// loginLockedFor returns how long the login attempt has to wait, or 0.
+func loginLockedFor(ls []loginLimit) (time.Duration, error) {
+	keys := make([]string, len(ls))
+	for i, l := range ls {
+		keys[i] = l.lockKey()
+	}
+	vs, err := redisClient.MGet(keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	now := time.Now()
+	for _, v := range vs {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		until, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		if d := time.Unix(until, 0).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// loginAttempt counts an attempt and returns how long it has to wait instead,
+// or 0 if the password may be checked.
+func loginAttempt(c echo.Context, ls []loginLimit) (time.Duration, error) {
+	if wait, err := loginLockedFor(ls); err != nil || wait > 0 {
+		return wait, err
+	}
+	for _, l := range ls {
+		pipe := redisClient.TxPipeline()
+		incr := pipe.Incr(l.failKey())
+		pipe.Expire(l.failKey(), loginFailTTL)
+		if _, err := pipe.Exec(); err != nil {
+			return 0, err
+		}
+		n := incr.Val()
+		if n <= l.limit {
+			continue
+		}
+		d := loginLockBase
+		for i := l.limit + 1; i < n && d < loginLockMax; i++ {
+			d *= 2
+		}
+		if d > loginLockMax {
+			d = loginLockMax
+		}
+		// whoever sets the lock gets the one attempt it allows
+		ok, err := redisClient.SetNX(l.lockKey(), time.Now().Add(d).Unix(), d).Result()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return loginLockedFor(ls)
+		}
+		log.Printf("audit: login locked %s=%q for %s after %d attempts (from %s, %q)",
+			l.scope, l.key, d, n, clientIP(c), c.Request().UserAgent())
+	}
+	return 0, nil
+}
+
+func loginSucceeded(ls []loginLimit) {
+	for _, l := range ls {
+		var err error
+		if l.scope == "user" {
+			err = redisClient.Del(l.failKey(), l.lockKey()).Err()
+		} else {
+			err = redisClient.Decr(l.failKey()).Err()
+		}
+		if err != nil {
+			log.Printf("login: %v", err)
+		}
+	}
+}
+
+func loginTooMany(c echo.Context, wait time.Duration) error {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests)
+}
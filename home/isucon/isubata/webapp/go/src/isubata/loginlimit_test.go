@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:40000", nil, "203.0.113.5"},
+		{"via nginx", "127.0.0.1:40000", map[string]string{"X-Real-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"via nginx over IPv6", "[::1]:40000", map[string]string{"X-Real-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"nginx without the header", "127.0.0.1:40000", nil, "127.0.0.1"},
+		{"spoofed X-Real-IP", "203.0.113.5:40000", map[string]string{"X-Real-IP": "10.0.0.1"}, "203.0.113.5"},
+		{"X-Forwarded-For is ignored", "127.0.0.1:40000", map[string]string{"X-Forwarded-For": "10.0.0.1"}, "127.0.0.1"},
+		{"X-Forwarded-For next to X-Real-IP", "127.0.0.1:40000",
+			map[string]string{"X-Real-IP": "203.0.113.5", "X-Forwarded-For": "10.0.0.1"}, "203.0.113.5"},
+		{"no port", "203.0.113.5", nil, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, "http://app1/login", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if got := requestIP(req); got != tt.want {
+			t.Errorf("%s: requestIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
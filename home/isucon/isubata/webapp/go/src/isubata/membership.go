@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+var cluster *membership
+
+// membership is the set of other app servers this node replicates to.
+type membership struct {
+	self      string
+	file      string
+	queueSize int
+
+	// port, lookupIP and localAddrs feed isSelf; tests replace them so it
+	// doesn't depend on the machine it runs on.
+	port       string
+	lookupIP   func(host string) ([]net.IP, error)
+	localAddrs func() ([]net.Addr, error)
+
+	peers map[string]*peer
+	m     sync.RWMutex
+}
+
+// initCluster builds the peer list from ISUBATA_PEERS, then the membership
+// file, then the old ISUBATA_OTHER_HOST1/2 pair.
+func initCluster() {
+	size, err := strconv.Atoi(os.Getenv("ISUBATA_SYNC_QUEUE_SIZE"))
+	if err != nil || size <= 0 {
+		size = 10000
+	}
+	_, port, _ := net.SplitHostPort(listenAddr)
+	cluster = &membership{
+		self:       os.Getenv("ISUBATA_SELF_HOST"),
+		file:       os.Getenv("ISUBATA_MEMBERSHIP_FILE"),
+		queueSize:  size,
+		port:       port,
+		lookupIP:   net.LookupIP,
+		localAddrs: net.InterfaceAddrs,
+		peers:      make(map[string]*peer),
+	}
+
+	var hosts []string
+	if v := os.Getenv("ISUBATA_PEERS"); v != "" {
+		hosts = strings.Split(v, ",")
+	} else if cluster.file != "" {
+		hosts, err = readMembershipFile(cluster.file)
+		if err != nil {
+			log.Printf("membership: failed to read %s: %v", cluster.file, err)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = []string{os.Getenv("ISUBATA_OTHER_HOST1"), os.Getenv("ISUBATA_OTHER_HOST2")}
+	}
+	for _, h := range hosts {
+		cluster.add(h)
+	}
+	log.Printf("membership: peers %v", cluster.Hosts())
+}
+
+func readMembershipFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, line)
+	}
+	return res, sc.Err()
+}
+
+func (c *membership) save() {
+	if c.file == "" {
+		return
+	}
+	buf := bytes.Buffer{}
+	for _, h := range c.Hosts() {
+		buf.WriteString(h + "\n")
+	}
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Printf("membership: failed to save: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.file); err != nil {
+		log.Printf("membership: failed to save: %v", err)
+	}
+}
+
+func (c *membership) add(host string) bool {
+	host = strings.TrimSpace(host)
+	if host == "" || c.isSelf(host) {
+		return false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.peers[host]; ok {
+		return false
+	}
+	c.peers[host] = newPeer(host, c.queueSize)
+	return true
+}
+
+// isSelf tells whether host is this node: its own name, or an address of one
+// of its interfaces on the port of the app or of nginx in front of it. The
+// same peer list can then be given to every node.
+func (c *membership) isSelf(host string) bool {
+	if host == c.self {
+		return true
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, "80"
+	}
+	if port != c.port && port != "80" {
+		return false
+	}
+	ips, err := c.lookupIP(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := c.localAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, ip := range ips {
+			if n.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *membership) Add(host string) bool {
+	if !c.add(host) {
+		return false
+	}
+	log.Printf("membership: %s joined", host)
+	c.save()
+	return true
+}
+
+func (c *membership) Remove(host string) bool {
+	c.m.Lock()
+	p, ok := c.peers[host]
+	delete(c.peers, host)
+	c.m.Unlock()
+	if !ok {
+		return false
+	}
+	p.stop()
+	log.Printf("membership: %s left", host)
+	c.save()
+	return true
+}
+
+func (c *membership) Peers() []*peer {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	res := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].host < res[j].host
+	})
+	return res
+}
+
+func (c *membership) Hosts() []string {
+	ps := c.Peers()
+	res := make([]string, 0, len(ps))
+	for _, p := range ps {
+		res = append(res, p.host)
+	}
+	return res
+}
+
+// Join announces this node to every known peer and adds the peers they know
+// about, until no new host shows up.
+func (c *membership) Join() {
+	if c.self == "" {
+		log.Println("membership: ISUBATA_SELF_HOST is not set, not announcing")
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"host": c.self})
+	asked := make(map[string]bool)
+	for {
+		var next []string
+		for _, h := range c.Hosts() {
+			if !asked[h] {
+				next = append(next, h)
+			}
+		}
+		if len(next) == 0 {
+			return
+		}
+		for _, h := range next {
+			asked[h] = true
+			hosts, err := postJoin(h, body)
+			if err != nil {
+				log.Printf("membership: failed to join via %s: %v", h, err)
+				continue
+			}
+			for _, o := range hosts {
+				c.Add(o)
+			}
+		}
+	}
+}
+
+func postJoin(host string, body []byte) ([]string, error) {
+	req, err := newSyncRequest(http.MethodPost, "http://"+host+"/sync/join", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	hosts := make([]string, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+type memberRequest struct {
+	Host string `json:"host" form:"host"`
+}
+
+func syncJoin(c echo.Context) error {
+	r := memberRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if r.Host == "" {
+		return ErrBadReqeust
+	}
+	cluster.Add(r.Host)
+	hosts := cluster.Hosts()
+	if cluster.self != "" {
+		hosts = append(hosts, cluster.self)
+	}
+	return c.JSON(http.StatusOK, hosts)
+}
+
+// announceLeave passes the leave of host on to the remaining peers. They
+// pass it on only if it was news to them, so it dies out once all know.
+func (c *membership) announceLeave(host string) {
+	body, _ := json.Marshal(memberRequest{Host: host})
+	for _, h := range c.Hosts() {
+		req, err := newSyncRequest(http.MethodPost, "http://"+h+"/sync/leave", body)
+		if err != nil {
+			log.Printf("membership: failed to tell %s that %s left: %v", h, host, err)
+			continue
+		}
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		resp, err := syncClient.Do(req)
+		if err != nil {
+			log.Printf("membership: failed to tell %s that %s left: %v", h, host, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func syncLeave(c echo.Context) error {
+	r := memberRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if r.Host == "" {
+		return ErrBadReqeust
+	}
+	// a node told that it leaves itself tells the others
+	if cluster.isSelf(r.Host) || cluster.Remove(r.Host) {
+		go cluster.announceLeave(r.Host)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getMembers(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"self":  cluster.self,
+		"peers": cluster.Hosts(),
+	})
+}
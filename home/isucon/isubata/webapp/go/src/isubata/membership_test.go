@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMembershipIsSelf(t *testing.T) {
+	hosts := map[string][]net.IP{
+		"app1-alias": {net.ParseIP("10.0.0.5")},
+		"10.0.0.5":   {net.ParseIP("10.0.0.5")},
+		"app2":       {net.ParseIP("10.0.0.6")},
+		"192.0.2.1":  {net.ParseIP("192.0.2.1")},
+	}
+	c := &membership{
+		self: "app1",
+		port: "5000",
+		lookupIP: func(host string) ([]net.IP, error) {
+			if ips, ok := hosts[host]; ok {
+				return ips, nil
+			}
+			return nil, errors.New("no such host")
+		},
+		localAddrs: func() ([]net.Addr, error) {
+			_, n, _ := net.ParseCIDR("10.0.0.5/24")
+			n.IP = net.ParseIP("10.0.0.5")
+			return []net.Addr{n}, nil
+		},
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"app1", true},
+		{"app1-alias", true},
+		{"10.0.0.5", true},
+		{"10.0.0.5:80", true},
+		{"10.0.0.5:5000", true},
+		{"app1-alias:5000", true},
+		{"10.0.0.5:6000", false},
+		{"app2", false},
+		{"app2:5000", false},
+		{"192.0.2.1", false},
+		{"unknown:5000", false},
+	}
+	for _, tt := range tests {
+		if got := c.isSelf(tt.host); got != tt.want {
+			t.Errorf("isSelf(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
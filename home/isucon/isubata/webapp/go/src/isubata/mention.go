@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// mentionRe matches @name. Names can be Japanese, so letters and digits are
+// Unicode ones rather than \w, which is ASCII only.
+var mentionRe = regexp.MustCompile(`@([\p{L}\p{N}_][\p{L}\p{M}\p{N}_.\-]*)`)
+
+// parseMentions resolves the @name tokens in content to user IDs, in order of
+// first appearance. Tokens that name no user are left as plain text.
+func parseMentions(content string) ([]int64, error) {
+	var res []int64
+	seen := make(map[int64]bool)
+	for _, sm := range mentionRe.FindAllStringSubmatch(content, -1) {
+		name := sm[1]
+		u, err := store.GetUserByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			// "@alice." at the end of a sentence
+			if u, err = store.GetUserByName(strings.TrimRight(name, ".-")); err != nil {
+				return nil, err
+			}
+		}
+		if u == nil || seen[u.ID] {
+			continue
+		}
+		seen[u.ID] = true
+		res = append(res, u.ID)
+	}
+	return res, nil
+}
+
+// getMentions serves GET /mentions: the messages that mention the current
+// user, newest first, each with its channel and whether it is still unread.
+// Pass the returned next_cursor as before to get older ones.
+func getMentions(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	before, err := queryInt64(c, "before")
+	if err != nil {
+		return err
+	}
+	limit := int64(apiDefaultLimit)
+	if c.QueryParam("limit") != "" {
+		limit, err = queryInt64(c, "limit")
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return ErrBadReqeust
+		}
+	}
+
+	ms, err := store.GetMentions(userID, before, int(limit))
+	if err != nil {
+		return err
+	}
+	read := make(map[int64]int64)
+	items := make([]map[string]interface{}, 0, len(ms))
+	for _, m := range ms {
+		last, ok := read[m.ChannelID]
+		if !ok {
+			if last, err = store.GetHaveRead(m.ChannelID, userID); err != nil {
+				return err
+			}
+			read[m.ChannelID] = last
+		}
+		r, err := jsonifyMessage(m)
+		if err != nil {
+			return err
+		}
+		r["channel_id"] = m.ChannelID
+		r["unread"] = m.ID > last
+		items = append(items, r)
+	}
+
+	var next interface{}
+	if len(ms) == int(limit) {
+		next = ms[len(ms)-1].ID
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"mentions":    items,
+		"next_cursor": next,
+	})
+}
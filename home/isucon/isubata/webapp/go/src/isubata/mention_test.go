@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	defer func(s Store) { store = s }(store)
+	s := newMemoryStore()
+	store = s
+	for _, u := range []*User{
+		{ID: 1, Name: "alice"},
+		{ID: 2, Name: "bob.smith"},
+		{ID: 3, Name: "田中"},
+		{ID: 4, Name: "ｓａｔｏ"},
+		{ID: 5, Name: "user_5"},
+	} {
+		s.PutUser(u)
+	}
+
+	tests := []struct {
+		content string
+		want    []int64
+	}{
+		{"hello", nil},
+		{"@alice hi", []int64{1}},
+		{"hi @alice.", []int64{1}},
+		{"@bob.smith and @alice and @alice", []int64{2, 1}},
+		{"@田中 こんにちは", []int64{3}},
+		{"ねえ@田中、見て", []int64{3}},
+		{"@ｓａｔｏ", []int64{4}},
+		{"@user_5!", []int64{5}},
+		{"@nobody @", nil},
+		{"mail alice@example.com", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseMentions(tt.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMentions(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
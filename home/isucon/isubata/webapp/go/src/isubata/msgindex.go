@@ -0,0 +1,195 @@
+package main
+
+import "sort"
+
+const messageIndexChunk = 512
+
+// messageIndex keeps a channel's messages sorted by ID. They are stored in
+// chunks of at most messageIndexChunk, so an out-of-order insert only shifts
+// one chunk, and a Fenwick tree over the chunk sizes turns a position into a
+// chunk in O(log n). Appending a newer message, the common case, just grows
+// the last chunk.
+type messageIndex struct {
+	chunks [][]*Message
+	tree   []int
+	n      int
+}
+
+func (x *messageIndex) Len() int {
+	return x.n
+}
+
+// Insert adds m and reports false if a message with the same ID is present.
+func (x *messageIndex) Insert(m *Message) bool {
+	if len(x.chunks) == 0 {
+		x.chunks = [][]*Message{{m}}
+		x.n = 1
+		x.rebuild()
+		return true
+	}
+
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		c := x.chunks[i]
+		return c[len(c)-1].ID >= m.ID
+	})
+	if i == len(x.chunks) {
+		i--
+	}
+	c := x.chunks[i]
+	j := sort.Search(len(c), func(j int) bool {
+		return c[j].ID >= m.ID
+	})
+	if j < len(c) && c[j].ID == m.ID {
+		return false
+	}
+	c = append(c, nil)
+	copy(c[j+1:], c[j:])
+	c[j] = m
+	x.n++
+
+	if len(c) <= messageIndexChunk {
+		x.chunks[i] = c
+		x.add(i, 1)
+		return true
+	}
+
+	half := len(c) / 2
+	right := make([]*Message, len(c)-half, messageIndexChunk+1)
+	copy(right, c[half:])
+	x.chunks[i] = c[:half]
+	x.chunks = append(x.chunks, nil)
+	copy(x.chunks[i+2:], x.chunks[i+1:])
+	x.chunks[i+1] = right
+	x.rebuild()
+	return true
+}
+
+// locate returns the chunk that would hold id and the position of id in it.
+func (x *messageIndex) locate(id int64) (int, int) {
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		c := x.chunks[i]
+		return c[len(c)-1].ID >= id
+	})
+	if i == len(x.chunks) {
+		return i, 0
+	}
+	c := x.chunks[i]
+	j := sort.Search(len(c), func(j int) bool {
+		return c[j].ID >= id
+	})
+	return i, j
+}
+
+// Replace swaps in m for the message with the same ID, if there is one.
+func (x *messageIndex) Replace(m *Message) bool {
+	i, j := x.locate(m.ID)
+	if i == len(x.chunks) || x.chunks[i][j].ID != m.ID {
+		return false
+	}
+	x.chunks[i][j] = m
+	return true
+}
+
+// Remove drops the message with the given ID and reports whether it was there.
+func (x *messageIndex) Remove(id int64) bool {
+	i, j := x.locate(id)
+	if i == len(x.chunks) || x.chunks[i][j].ID != id {
+		return false
+	}
+	c := x.chunks[i]
+	copy(c[j:], c[j+1:])
+	c[len(c)-1] = nil
+	x.chunks[i] = c[:len(c)-1]
+	x.n--
+	if len(x.chunks[i]) > 0 {
+		x.add(i, -1)
+		return true
+	}
+	copy(x.chunks[i:], x.chunks[i+1:])
+	x.chunks[len(x.chunks)-1] = nil
+	x.chunks = x.chunks[:len(x.chunks)-1]
+	x.rebuild()
+	return true
+}
+
+func (x *messageIndex) rebuild() {
+	x.tree = make([]int, len(x.chunks)+1)
+	for i, c := range x.chunks {
+		x.tree[i+1] += len(c)
+		if p := (i + 1) + ((i + 1) & -(i + 1)); p < len(x.tree) {
+			x.tree[p] += x.tree[i+1]
+		}
+	}
+}
+
+func (x *messageIndex) add(i, d int) {
+	for i++; i < len(x.tree); i += i & -i {
+		x.tree[i] += d
+	}
+}
+
+// prefix returns the number of messages in chunks before chunk i.
+func (x *messageIndex) prefix(i int) int {
+	s := 0
+	for ; i > 0; i -= i & -i {
+		s += x.tree[i]
+	}
+	return s
+}
+
+// find returns the chunk holding position pos and the offset inside it.
+func (x *messageIndex) find(pos int) (int, int) {
+	step := 1
+	for step*2 < len(x.tree) {
+		step *= 2
+	}
+	i := 0
+	for ; step > 0; step /= 2 {
+		if i+step < len(x.tree) && x.tree[i+step] <= pos {
+			i += step
+			pos -= x.tree[i]
+		}
+	}
+	return i, pos
+}
+
+// After returns the position of the first message with an ID greater than id.
+func (x *messageIndex) After(id int64) int {
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		c := x.chunks[i]
+		return c[len(c)-1].ID > id
+	})
+	if i == len(x.chunks) {
+		return x.n
+	}
+	c := x.chunks[i]
+	j := sort.Search(len(c), func(j int) bool {
+		return c[j].ID > id
+	})
+	return x.prefix(i) + j
+}
+
+// Slice returns the messages at positions [from, to).
+func (x *messageIndex) Slice(from, to int) []*Message {
+	if from < 0 {
+		from = 0
+	}
+	if to > x.n {
+		to = x.n
+	}
+	if from >= to {
+		return []*Message{}
+	}
+	res := make([]*Message, 0, to-from)
+	i, j := x.find(from)
+	for len(res) < to-from {
+		c := x.chunks[i][j:]
+		if rest := to - from - len(res); len(c) > rest {
+			c = c[:rest]
+		}
+		res = append(res, c...)
+		i++
+		j = 0
+	}
+	return res
+}
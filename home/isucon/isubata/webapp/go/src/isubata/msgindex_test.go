@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func indexIDs(ms []*Message) []int64 {
+	ids := make([]int64, len(ms))
+	for i, m := range ms {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkIndex compares x against want, which is sorted.
+func checkIndex(t *testing.T, x *messageIndex, want []int64) {
+	t.Helper()
+	if x.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", x.Len(), len(want))
+	}
+	if got := indexIDs(x.Slice(0, x.Len())); !equalIDs(got, want) {
+		t.Fatalf("Slice(0, %d) = %v, want %v", x.Len(), got, want)
+	}
+	for _, c := range x.chunks {
+		if len(c) == 0 || len(c) > messageIndexChunk {
+			t.Fatalf("chunk of %d messages", len(c))
+		}
+	}
+	for i := range x.chunks {
+		n := 0
+		for _, c := range x.chunks[:i] {
+			n += len(c)
+		}
+		if p := x.prefix(i); p != n {
+			t.Fatalf("prefix(%d) = %d, want %d", i, p, n)
+		}
+	}
+	for _, pos := range []int{0, len(want) / 3, len(want) / 2, len(want) - 1} {
+		if pos < 0 || pos >= len(want) {
+			continue
+		}
+		got := indexIDs(x.Slice(pos, pos+10))
+		end := pos + 10
+		if end > len(want) {
+			end = len(want)
+		}
+		if !equalIDs(got, want[pos:end]) {
+			t.Fatalf("Slice(%d, %d) = %v, want %v", pos, pos+10, got, want[pos:end])
+		}
+	}
+	for _, id := range []int64{0, 1, 500, 1000, 5000} {
+		wantPos := sort.Search(len(want), func(i int) bool { return want[i] > id })
+		if p := x.After(id); p != wantPos {
+			t.Fatalf("After(%d) = %d, want %d", id, p, wantPos)
+		}
+	}
+}
+
+func TestMessageIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		insert []int64
+		remove []int64
+	}{
+		{"empty", nil, nil},
+		{"one", []int64{7}, nil},
+		{"appends", seqIDs(1, 2000), nil},
+		{"reverse", reverseIDs(seqIDs(1, 2000)), nil},
+		{"duplicates", []int64{3, 1, 3, 2, 1}, nil},
+		{"remove some", seqIDs(1, 1500), []int64{1, 512, 513, 1024, 1500, 9999}},
+		{"remove all", seqIDs(1, 600), seqIDs(1, 600)},
+		{"shuffled", shuffledIDs(1, 3000, 1), shuffledIDs(1, 3000, 2)[:1200]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &messageIndex{}
+			model := make(map[int64]bool)
+			for _, id := range tt.insert {
+				if ok := x.Insert(&Message{ID: id}); ok == model[id] {
+					t.Fatalf("Insert(%d) = %v with present=%v", id, ok, model[id])
+				}
+				model[id] = true
+			}
+			checkIndex(t, x, sortedKeys(model))
+
+			for _, id := range tt.remove {
+				if ok := x.Remove(id); ok != model[id] {
+					t.Fatalf("Remove(%d) = %v with present=%v", id, ok, model[id])
+				}
+				delete(model, id)
+			}
+			checkIndex(t, x, sortedKeys(model))
+
+			for id := range model {
+				m := &Message{ID: id, Content: "replaced"}
+				if !x.Replace(m) {
+					t.Fatalf("Replace(%d) = false", id)
+				}
+				break
+			}
+			if x.Replace(&Message{ID: -1}) {
+				t.Fatal("Replace of a missing ID = true")
+			}
+		})
+	}
+}
+
+func seqIDs(from, to int64) []int64 {
+	ids := make([]int64, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func reverseIDs(ids []int64) []int64 {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids
+}
+
+func shuffledIDs(from, to, seed int64) []int64 {
+	ids := seqIDs(from, to)
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids
+}
+
+func sortedKeys(m map[int64]bool) []int64 {
+	ids := make([]int64, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
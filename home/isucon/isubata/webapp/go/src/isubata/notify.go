@@ -0,0 +1,60 @@
+package main
+
+import "sync"
+
+var (
+	unreadNotifier  = newNotifier()
+	channelNotifier = newNotifier()
+)
+
+// notifyNewMessage wakes up everything waiting on a message being stored,
+// whether it was posted here or arrived from a peer.
+func notifyNewMessage(m *Message) {
+	unreadNotifier.NotifyAll()
+	channelNotifier.Notify(m.ChannelID)
+}
+
+// notifier wakes up requests waiting for something new for a key, such as a
+// user or channel ID. Wait has to be called before checking state so no
+// wakeup is lost.
+type notifier struct {
+	waiters map[int64]chan struct{}
+	m       sync.Mutex
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		waiters: make(map[int64]chan struct{}),
+	}
+}
+
+func (n *notifier) Wait(key int64) <-chan struct{} {
+	n.m.Lock()
+	defer n.m.Unlock()
+	ch, ok := n.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[key] = ch
+	}
+	return ch
+}
+
+func (n *notifier) Notify(key int64) {
+	n.m.Lock()
+	ch, ok := n.waiters[key]
+	delete(n.waiters, key)
+	n.m.Unlock()
+	if ok {
+		close(ch)
+	}
+}
+
+func (n *notifier) NotifyAll() {
+	n.m.Lock()
+	ws := n.waiters
+	n.waiters = make(map[int64]chan struct{})
+	n.m.Unlock()
+	for _, ch := range ws {
+		close(ch)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User.Password starts with the scheme it was hashed with. Passwords from
+// before schemes existed have no prefix and are hex SHA-1 of Salt+password;
+// they are rehashed with bcrypt the next time the user logs in.
+const (
+	passwordBcrypt = "bcrypt$"
+	passwordSHA1   = "sha1$"
+
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordLen = 72
+)
+
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordLen {
+		return "", ErrBadReqeust
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return passwordBcrypt + string(h), nil
+}
+
+// checkPassword reports whether password is u's and whether the stored hash
+// should be replaced with one from hashPassword.
+func checkPassword(u *User, password string) (bool, bool) {
+	switch {
+	case strings.HasPrefix(u.Password, passwordBcrypt):
+		h := []byte(strings.TrimPrefix(u.Password, passwordBcrypt))
+		if bcrypt.CompareHashAndPassword(h, []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(h)
+		return true, err == nil && cost < bcrypt.DefaultCost
+	default:
+		digest := fmt.Sprintf("%x", sha1.Sum([]byte(u.Salt+password)))
+		stored := strings.TrimPrefix(u.Password, passwordSHA1)
+		if subtle.ConstantTimeCompare([]byte(digest), []byte(stored)) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+// rehashPassword stores a fresh hash of password for u and replicates it.
+// Failing to do so only delays the migration, so errors are just logged.
+func rehashPassword(u *User, password string) {
+	h, err := hashPassword(password)
+	if err != nil {
+		log.Printf("password: failed to rehash user %d: %v", u.ID, err)
+		return
+	}
+	nu := *u
+	nu.Password = h
+	nu.Salt = ""
+	nu.UpdatedAt = time.Now()
+	if err := store.PutUser(&nu); err != nil {
+		log.Printf("password: failed to rehash user %d: %v", u.ID, err)
+		return
+	}
+	replicateUser(&nu)
+}
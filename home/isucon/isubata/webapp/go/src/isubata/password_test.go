@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	sha := func(salt, pw string) string {
+		return fmt.Sprintf("%x", sha1.Sum([]byte(salt+pw)))
+	}
+	bc := func(pw string, cost int) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return passwordBcrypt + string(h)
+	}
+	current, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		user       User
+		password   string
+		ok, rehash bool
+	}{
+		{"legacy sha1", User{Salt: "salt", Password: sha("salt", "secret")}, "secret", true, true},
+		{"legacy sha1 wrong", User{Salt: "salt", Password: sha("salt", "secret")}, "secreT", false, false},
+		{"legacy sha1 wrong salt", User{Salt: "pepper", Password: sha("salt", "secret")}, "secret", false, false},
+		{"prefixed sha1", User{Salt: "salt", Password: passwordSHA1 + sha("salt", "secret")}, "secret", true, true},
+		{"bcrypt", User{Password: current}, "secret", true, false},
+		{"bcrypt wrong", User{Password: current}, "Secret", false, false},
+		{"bcrypt low cost", User{Password: bc("secret", bcrypt.MinCost)}, "secret", true, true},
+		{"empty hash", User{}, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := checkPassword(&tt.user, tt.password)
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("checkPassword = %v, %v; want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestPasswordMigration(t *testing.T) {
+	u := &User{Salt: "salt", Password: fmt.Sprintf("%x", sha1.Sum([]byte("saltsecret")))}
+	ok, rehash := checkPassword(u, "secret")
+	if !ok || !rehash {
+		t.Fatalf("legacy checkPassword = %v, %v; want true, true", ok, rehash)
+	}
+	h, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Password, u.Salt = h, ""
+	if ok, rehash := checkPassword(u, "secret"); !ok || rehash {
+		t.Fatalf("migrated checkPassword = %v, %v; want true, false", ok, rehash)
+	}
+	if ok, _ := checkPassword(u, "wrong"); ok {
+		t.Fatal("migrated hash accepts a wrong password")
+	}
+	if _, err := hashPassword(string(make([]byte, maxPasswordLen+1))); err == nil {
+		t.Fatal("hashPassword accepts a password bcrypt would truncate")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const maxEmojiLen = 64
+
+// reactionTarget parses :id and :emoji and checks that the message exists.
+func reactionTarget(c echo.Context) (int64, int64, string, error) {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return 0, 0, "", echo.ErrForbidden
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, 0, "", ErrBadReqeust
+	}
+	emoji, err := url.PathUnescape(c.Param("emoji"))
+	if err != nil || emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return 0, 0, "", ErrBadReqeust
+	}
+	m, err := store.GetMessage(id)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if m == nil || m.Deleted() {
+		return 0, 0, "", ErrMessageNotFound
+	}
+	return id, userID, emoji, nil
+}
+
+func postReaction(c echo.Context) error {
+	id, userID, emoji, err := reactionTarget(c)
+	if err != nil {
+		return err
+	}
+	if err := store.AddReaction(id, userID, emoji); err != nil {
+		return err
+	}
+	replicateReaction(syncOpAddReaction, id, userID, emoji)
+	return reactionsResponse(c, id, userID)
+}
+
+func deleteReaction(c echo.Context) error {
+	id, userID, emoji, err := reactionTarget(c)
+	if err != nil {
+		return err
+	}
+	if err := store.RemoveReaction(id, userID, emoji); err != nil {
+		return err
+	}
+	replicateReaction(syncOpRemoveReaction, id, userID, emoji)
+	return reactionsResponse(c, id, userID)
+}
+
+func reactionsResponse(c echo.Context, messageID, userID int64) error {
+	rs, err := jsonifyReactions(messageID, userID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":        messageID,
+		"reactions": rs,
+	})
+}
+
+// jsonifyReactions returns the reaction counts of a message, most used first,
+// and whether userID is among the users behind each of them.
+func jsonifyReactions(messageID, userID int64) ([]map[string]interface{}, error) {
+	rs, err := store.GetReactions(messageID)
+	if err != nil {
+		return nil, err
+	}
+	emojis := make([]string, 0, len(rs))
+	for e := range rs {
+		emojis = append(emojis, e)
+	}
+	sort.Slice(emojis, func(i, j int) bool {
+		a, b := len(rs[emojis[i]]), len(rs[emojis[j]])
+		if a != b {
+			return a > b
+		}
+		return emojis[i] < emojis[j]
+	})
+	res := make([]map[string]interface{}, 0, len(emojis))
+	for _, e := range emojis {
+		me := false
+		for _, id := range rs[e] {
+			if id == userID {
+				me = true
+				break
+			}
+		}
+		res = append(res, map[string]interface{}{
+			"emoji": e,
+			"count": len(rs[e]),
+			"me":    me,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	replicationMinBackoff = 50 * time.Millisecond
+	replicationMaxBackoff = 5 * time.Second
+	replicationBatchSize  = 500
+	// a batch still failing after this many attempts is dropped
+	replicationMaxAttempts = 20
+)
+
+var syncClient = &http.Client{Timeout: 3 * time.Second}
+
+type syncEvent struct {
+	op *syncOp
+	at time.Time
+}
+
+type peerStats struct {
+	Host       string  `json:"host"`
+	Pending    int     `json:"pending"`
+	Delivered  int64   `json:"delivered"`
+	Retries    int64   `json:"retries"`
+	Dropped    int64   `json:"dropped"`
+	Rejected   int64   `json:"rejected"`
+	LagSeconds float64 `json:"lag_seconds"`
+	LastDelay  float64 `json:"last_delay_seconds"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// peer delivers events to one other app server in the order they were
+// queued, as batches posted to /sync/batch. The peer applies a batch op by
+// op and says how far it got; the rest is retried with backoff, and dropped
+// after replicationMaxAttempts. Ops the peer rejects, and whole batches it
+// can't decode, are dropped right away since resending can't help.
+// When the queue is full new events are dropped.
+type peer struct {
+	host  string
+	queue chan *syncEvent
+	done  chan struct{}
+
+	m        sync.Mutex
+	head     *syncEvent
+	inFlight int
+	gen      int
+	stats    peerStats
+}
+
+func newPeer(host string, size int) *peer {
+	p := &peer{
+		host:  host,
+		queue: make(chan *syncEvent, size),
+		done:  make(chan struct{}),
+	}
+	p.stats.Host = host
+	go p.run()
+	return p
+}
+
+func (p *peer) enqueue(ev *syncEvent) {
+	select {
+	case p.queue <- ev:
+	default:
+		p.m.Lock()
+		p.stats.Dropped++
+		p.m.Unlock()
+		log.Printf("sync: queue for %s is full, dropped op %d", p.host, ev.op.Kind)
+	}
+}
+
+// clear drops everything still queued, including an event being retried.
+func (p *peer) clear() {
+	p.m.Lock()
+	p.gen++
+	p.m.Unlock()
+	for {
+		select {
+		case <-p.queue:
+		default:
+			return
+		}
+	}
+}
+
+// stop ends the worker once the event in flight is finished or given up.
+func (p *peer) stop() {
+	close(p.done)
+	p.clear()
+}
+
+func (p *peer) run() {
+	for {
+		var ev *syncEvent
+		select {
+		case ev = <-p.queue:
+		case <-p.done:
+			return
+		}
+
+		batch := []*syncEvent{ev}
+	drain:
+		for len(batch) < replicationBatchSize {
+			select {
+			case ev = <-p.queue:
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+
+		p.m.Lock()
+		p.head = batch[0]
+		p.inFlight = len(batch)
+		gen := p.gen
+		p.m.Unlock()
+
+		ops := coalesceSyncOps(batch)
+		backoff := replicationMinBackoff
+		for attempt := 1; ; attempt++ {
+			res, err := p.deliver(ops)
+
+			p.m.Lock()
+			switch {
+			case err == nil:
+				for _, r := range res.Rejected {
+					log.Printf("sync: %s rejected op #%d: %s", p.host, r.Index, r.Error)
+				}
+				p.stats.Delivered += int64(res.Done - len(res.Rejected))
+				p.stats.Rejected += int64(len(res.Rejected))
+				ops = ops[res.Done:]
+				if len(ops) == 0 {
+					p.stats.LastDelay = time.Since(batch[0].at).Seconds()
+					p.stats.LastError = ""
+				} else {
+					p.stats.Retries++
+					p.stats.LastError = res.Error
+				}
+			case isPermanentSyncError(err):
+				log.Printf("sync: %s rejected a batch of %d ops: %v", p.host, len(ops), err)
+				p.stats.Rejected += int64(len(ops))
+				p.stats.LastError = err.Error()
+				ops = nil
+			default:
+				p.stats.Retries++
+				p.stats.LastError = err.Error()
+			}
+			if len(ops) > 0 && attempt == replicationMaxAttempts {
+				log.Printf("sync: giving up on %d ops for %s: %s", len(ops), p.host, p.stats.LastError)
+				p.stats.Dropped += int64(len(ops))
+				ops = nil
+			}
+			cleared := p.gen != gen
+			p.m.Unlock()
+
+			if len(ops) == 0 || cleared {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > replicationMaxBackoff {
+				backoff = replicationMaxBackoff
+			}
+		}
+
+		p.m.Lock()
+		p.head = nil
+		p.inFlight = 0
+		p.m.Unlock()
+	}
+}
+
+// syncStatusError is a /sync/batch response that isn't a batch result.
+type syncStatusError struct {
+	code   int
+	status string
+}
+
+func (e *syncStatusError) Error() string {
+	return "POST /sync/batch: " + e.status
+}
+
+// isPermanentSyncError tells whether resending the batch is pointless. Only a
+// 400, a batch that doesn't decode, is; a 401 from clock skew or a secret
+// that is being rotated, a 429 and the like clear up on their own.
+func isPermanentSyncError(err error) bool {
+	se, ok := err.(*syncStatusError)
+	return ok && se.code == http.StatusBadRequest
+}
+
+func (p *peer) deliver(ops []*syncOp) (*syncBatchResult, error) {
+	body, err := encodeSyncBatch(ops)
+	if err != nil {
+		return nil, &syncStatusError{http.StatusBadRequest, err.Error()}
+	}
+	req, err := newSyncRequest(http.MethodPost, "http://"+p.host+"/sync/batch", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, syncBatchMIME)
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, &syncStatusError{resp.StatusCode, resp.Status}
+	}
+	res := &syncBatchResult{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Done > len(ops) {
+		return nil, fmt.Errorf("POST /sync/batch: %d of %d ops done", res.Done, len(ops))
+	}
+	return res, nil
+}
+
+// encodeSyncBatch writes ops as one gob stream, so type information is sent
+// once per batch.
+func encodeSyncBatch(ops []*syncOp) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// coalesceSyncOps keeps only the latest version of each user and have-read
+// position, at the place the first one was queued.
+func coalesceSyncOps(batch []*syncEvent) []*syncOp {
+	type haveReadKey struct{ chanID, userID int64 }
+	users := make(map[int64]int)
+	haveReads := make(map[haveReadKey]int)
+	res := make([]*syncOp, 0, len(batch))
+	for _, ev := range batch {
+		op := ev.op
+		switch op.Kind {
+		case syncOpUser:
+			if i, ok := users[op.User.ID]; ok {
+				res[i] = op
+				continue
+			}
+			users[op.User.ID] = len(res)
+		case syncOpHaveRead:
+			k := haveReadKey{op.ChannelID, op.UserID}
+			if i, ok := haveReads[k]; ok {
+				res[i] = op
+				continue
+			}
+			haveReads[k] = len(res)
+		}
+		res = append(res, op)
+	}
+	return res
+}
+
+func (p *peer) Stats() peerStats {
+	p.m.Lock()
+	defer p.m.Unlock()
+	st := p.stats
+	st.Pending = len(p.queue) + p.inFlight
+	if p.head != nil {
+		st.LagSeconds = time.Since(p.head.at).Seconds()
+	}
+	return st
+}
+
+// replicate queues op for every peer. The caller must not modify what op
+// points to afterwards.
+func replicate(op *syncOp) {
+	ev := &syncEvent{
+		op: op,
+		at: time.Now(),
+	}
+	for _, p := range cluster.Peers() {
+		p.enqueue(ev)
+	}
+}
+
+func replicateUser(u *User) {
+	cp := *u
+	replicate(&syncOp{Kind: syncOpUser, User: &cp})
+}
+
+func replicateChannel(ch *Channel) {
+	replicate(&syncOp{Kind: syncOpChannel, Channel: ch.Clone()})
+}
+
+func replicateMessage(m *Message) {
+	cp := *m
+	cp.User = nil
+	replicate(&syncOp{Kind: syncOpMessage, Message: &cp})
+}
+
+func replicateEditMessage(m *Message) {
+	cp := *m
+	cp.User = nil
+	replicate(&syncOp{Kind: syncOpEditMessage, Message: &cp})
+}
+
+func replicateDeleteMessage(m *Message) {
+	cp := *m
+	cp.User = nil
+	replicate(&syncOp{Kind: syncOpDeleteMessage, Message: &cp})
+}
+
+func replicateReaction(kind int, messageID, userID int64, emoji string) {
+	replicate(&syncOp{Kind: kind, MessageID: messageID, UserID: userID, Emoji: emoji})
+}
+
+func replicateHaveRead(chanID, userID, messageID int64) {
+	replicate(&syncOp{Kind: syncOpHaveRead, ChannelID: chanID, UserID: userID, MessageID: messageID})
+}
+
+func getReplicationStatus(c echo.Context) error {
+	ps := cluster.Peers()
+	res := make([]peerStats, 0, len(ps))
+	for _, p := range ps {
+		res = append(res, p.Stats())
+	}
+	return c.JSON(http.StatusOK, res)
+}
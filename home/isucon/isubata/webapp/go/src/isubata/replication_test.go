@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestIsPermanentSyncError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&syncStatusError{http.StatusBadRequest, "400 Bad Request"}, true},
+		{&syncStatusError{http.StatusUnauthorized, "401 Unauthorized"}, false},
+		{&syncStatusError{http.StatusForbidden, "403 Forbidden"}, false},
+		{&syncStatusError{http.StatusRequestTimeout, "408 Request Timeout"}, false},
+		{&syncStatusError{http.StatusTooManyRequests, "429 Too Many Requests"}, false},
+		{&syncStatusError{http.StatusBadGateway, "502 Bad Gateway"}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isPermanentSyncError(tt.err); got != tt.want {
+			t.Errorf("isPermanentSyncError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
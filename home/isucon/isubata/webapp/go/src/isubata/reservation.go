@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// A name is reserved in Redis before the user is stored, so two nodes can't
+// both register it. Users that already share a name, from before names were
+// reserved, are settled by resolveDuplicateNames: the lower ID keeps the name,
+// matching the memory store's index, and the other user is renamed.
+
+func nameKey(name string) string {
+	return "username:" + name
+}
+
+// reserveName claims name for id. Claiming a name id already holds is fine.
+func reserveName(name string, id int64) error {
+	ok, err := redisClient.SetNX(nameKey(name), id, 0).Result()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	holder, err := redisClient.Get(nameKey(name)).Int64()
+	if err == redis.Nil {
+		// released in between; try once more
+		return reserveName(name, id)
+	}
+	if err != nil {
+		return err
+	}
+	if holder != id {
+		return ErrNameTaken
+	}
+	return nil
+}
+
+// releaseName drops the reservation of name if id still holds it.
+func releaseName(name string, id int64) {
+	holder, err := redisClient.Get(nameKey(name)).Result()
+	if err == redis.Nil {
+		return
+	}
+	if err == nil && holder == strconv.FormatInt(id, 10) {
+		err = redisClient.Del(nameKey(name)).Err()
+	}
+	if err != nil {
+		log.Printf("names: failed to release %q: %v", name, err)
+	}
+}
+
+// settleNames reserves the names of the stored users and renames the ones
+// sharing a name. It runs at boot and after /initialize, since neither the
+// seed data nor the WAL goes through register and FlushDB drops every
+// reservation.
+func settleNames() {
+	if err := reserveStoredNames(); err != nil {
+		log.Printf("names: failed to reserve stored names: %v", err)
+	}
+	resolveDuplicateNames()
+}
+
+// storedUsers returns the stored users by ID.
+func storedUsers() ([]*User, error) {
+	us, err := store.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].ID < us[j].ID })
+	return us, nil
+}
+
+// reserveStoredNames claims the name of every stored user that isn't
+// reserved yet. Lower IDs go first, so a shared name ends up with the user
+// that keeps it.
+func reserveStoredNames() error {
+	us, err := storedUsers()
+	if err != nil || len(us) == 0 {
+		return err
+	}
+	pipe := redisClient.Pipeline()
+	for _, u := range us {
+		pipe.SetNX(nameKey(u.Name), u.ID, 0)
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// resolveDuplicateNames renames the stored users that lost their name to a
+// user with a lower ID. Every node picks the same loser and new name, so
+// running it on all of them converges.
+func resolveDuplicateNames() {
+	us, err := storedUsers()
+	if err != nil {
+		log.Printf("names: failed to list users: %v", err)
+		return
+	}
+	owners := make(map[string]int64, len(us))
+	for _, u := range us {
+		owner, ok := owners[u.Name]
+		if !ok {
+			owners[u.Name] = u.ID
+			continue
+		}
+		name := fmt.Sprintf("%s_%d", u.Name, u.ID)
+		if err := reserveName(name, u.ID); err != nil {
+			log.Printf("names: can't rename user %d to %q: %v", u.ID, name, err)
+			continue
+		}
+		nu := *u
+		nu.Name = name
+		nu.UpdatedAt = time.Now()
+		if err := store.PutUser(&nu); err != nil {
+			log.Printf("names: can't rename user %d to %q: %v", u.ID, name, err)
+			continue
+		}
+		replicateUser(&nu)
+		// the old name may have been reserved for the loser
+		releaseName(u.Name, u.ID)
+		if err := reserveName(u.Name, owner); err != nil {
+			log.Printf("names: can't reserve %q for user %d: %v", u.Name, owner, err)
+		}
+		log.Printf("names: renamed user %d from %q to %q", u.ID, u.Name, name)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo"
+)
+
+// normalize lower-cases s and folds full-width ASCII to half-width, so that
+// "Ｇｏ" and "go" match.
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 0xFF01 <= r && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || r == 'ー'
+}
+
+// splitRuns calls fn with each word and each run of CJK characters of the
+// normalized s. Anything else separates them.
+func splitRuns(s string, fn func(run []rune, cjk bool)) {
+	var word, cjk []rune
+	flush := func() {
+		if len(word) > 0 {
+			fn(word, false)
+			word = word[:0]
+		}
+		if len(cjk) > 0 {
+			fn(cjk, true)
+			cjk = cjk[:0]
+		}
+	}
+	for _, r := range normalize(s) {
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+}
+
+// tokenize splits s into words and runs of CJK characters. Words are terms
+// as they are. CJK text has no spaces, so a run becomes its bigrams, plus its
+// single characters when unigrams is set so that one-character queries work.
+func tokenize(s string, unigrams bool) []string {
+	res := make([]string, 0)
+	splitRuns(s, func(run []rune, cjk bool) {
+		if !cjk {
+			res = append(res, string(run))
+			return
+		}
+		if len(run) == 1 || unigrams {
+			for _, r := range run {
+				res = append(res, string(r))
+			}
+		}
+		for i := 0; i+1 < len(run); i++ {
+			res = append(res, string(run[i:i+2]))
+		}
+	})
+	return res
+}
+
+func uniqueTerms(ts []string) []string {
+	seen := make(map[string]bool, len(ts))
+	res := ts[:0]
+	for _, t := range ts {
+		if !seen[t] {
+			seen[t] = true
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+type searchDoc struct {
+	channelID, userID int64
+	terms             []string
+}
+
+// searchIndex is an inverted index from terms to sorted message IDs.
+type searchIndex struct {
+	postings map[string][]int64
+	docs     map[int64]*searchDoc
+	m        sync.RWMutex
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string][]int64),
+		docs:     make(map[int64]*searchDoc),
+	}
+}
+
+func (x *searchIndex) Put(m *Message) {
+	x.m.Lock()
+	defer x.m.Unlock()
+	x.remove(m.ID)
+	if m.Deleted() {
+		return
+	}
+	d := &searchDoc{
+		channelID: m.ChannelID,
+		userID:    m.UserID,
+		terms:     uniqueTerms(tokenize(m.Content, true)),
+	}
+	x.docs[m.ID] = d
+	for _, t := range d.terms {
+		ids := x.postings[t]
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= m.ID })
+		ids = append(ids, 0)
+		copy(ids[i+1:], ids[i:])
+		ids[i] = m.ID
+		x.postings[t] = ids
+	}
+}
+
+func (x *searchIndex) remove(id int64) {
+	d, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	delete(x.docs, id)
+	for _, t := range d.terms {
+		ids := x.postings[t]
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+		if i < len(ids) && ids[i] == id {
+			ids = append(ids[:i], ids[i+1:]...)
+		}
+		if len(ids) == 0 {
+			delete(x.postings, t)
+		} else {
+			x.postings[t] = ids
+		}
+	}
+}
+
+type searchQuery struct {
+	terms     []string
+	channelID int64
+	userID    int64
+	before    int64
+	after     int64
+}
+
+// Search returns the IDs of up to limit messages containing every term that
+// match the filters, newest first.
+func (x *searchIndex) Search(q *searchQuery, limit int) []int64 {
+	x.m.RLock()
+	defer x.m.RUnlock()
+	if len(q.terms) == 0 {
+		return []int64{}
+	}
+	lists := make([][]int64, 0, len(q.terms))
+	for _, t := range q.terms {
+		ids, ok := x.postings[t]
+		if !ok {
+			return []int64{}
+		}
+		lists = append(lists, ids)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	res := make([]int64, 0)
+	first := lists[0]
+	if q.before > 0 {
+		first = first[:sort.Search(len(first), func(i int) bool { return first[i] >= q.before })]
+	}
+	for i := len(first) - 1; i >= 0 && len(res) < limit; i-- {
+		id := first[i]
+		if id <= q.after {
+			break
+		}
+		d := x.docs[id]
+		if q.channelID != 0 && d.channelID != q.channelID {
+			continue
+		}
+		if q.userID != 0 && d.userID != q.userID {
+			continue
+		}
+		all := true
+		for _, ids := range lists[1:] {
+			j := sort.Search(len(ids), func(j int) bool { return ids[j] >= id })
+			if j == len(ids) || ids[j] != id {
+				all = false
+				break
+			}
+		}
+		if all {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// searchStore keeps a searchIndex in step with the messages of the store it
+// wraps.
+type searchStore struct {
+	Store
+	idx *searchIndex
+}
+
+func newSearchStore(s Store) (*searchStore, error) {
+	ss := &searchStore{Store: s}
+	if err := ss.rebuild(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (s *searchStore) rebuild() error {
+	start := time.Now()
+	d, err := s.Store.Dump()
+	if err != nil {
+		return err
+	}
+	idx := newSearchIndex()
+	for _, m := range d.Messages {
+		idx.Put(m)
+	}
+	log.Printf("search: indexed %d messages in %v", len(idx.docs), time.Since(start))
+	if s.idx == nil {
+		s.idx = idx
+		return nil
+	}
+	s.idx.m.Lock()
+	s.idx.postings, s.idx.docs = idx.postings, idx.docs
+	s.idx.m.Unlock()
+	return nil
+}
+
+func (s *searchStore) Reset() error {
+	if err := s.Store.Reset(); err != nil {
+		return err
+	}
+	return s.rebuild()
+}
+
+// reindex reads back what the wrapped store kept, since it may have ignored
+// a duplicate or stale write.
+func (s *searchStore) reindex(id int64) error {
+	m, err := s.Store.GetMessage(id)
+	if err != nil || m == nil {
+		return err
+	}
+	s.idx.Put(m)
+	return nil
+}
+
+func (s *searchStore) AddMessage(m *Message) error {
+	if err := s.Store.AddMessage(m); err != nil {
+		return err
+	}
+	return s.reindex(m.ID)
+}
+
+func (s *searchStore) EditMessage(m *Message) error {
+	if err := s.Store.EditMessage(m); err != nil {
+		return err
+	}
+	return s.reindex(m.ID)
+}
+
+func (s *searchStore) DeleteMessage(m *Message) error {
+	if err := s.Store.DeleteMessage(m); err != nil {
+		return err
+	}
+	return s.reindex(m.ID)
+}
+
+// matches checks the CJK runs of the query against the text, since the index
+// only guarantees that each of their bigrams occurs somewhere. Words and runs
+// of up to two characters are terms of their own and need no second look.
+func matches(content, q string) bool {
+	content = normalize(content)
+	ok := true
+	splitRuns(q, func(run []rune, cjk bool) {
+		if cjk && len(run) > 2 && !strings.Contains(content, string(run)) {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// getSearch serves GET /search. q is required; channel_id, user (a user
+// name), before and after narrow the results. Messages come newest first;
+// pass next_cursor as before to continue.
+func getSearch(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	ss, ok := store.(*searchStore)
+	if !ok {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "search is not available")
+	}
+	text := c.QueryParam("q")
+	q := &searchQuery{terms: uniqueTerms(tokenize(text, false))}
+	if len(q.terms) == 0 {
+		return ErrBadReqeust
+	}
+	var err error
+	if q.channelID, err = queryInt64(c, "channel_id"); err != nil {
+		return err
+	}
+	if q.before, err = queryInt64(c, "before"); err != nil {
+		return err
+	}
+	if q.after, err = queryInt64(c, "after"); err != nil {
+		return err
+	}
+	limit := int64(apiDefaultLimit)
+	if c.QueryParam("limit") != "" {
+		limit, err = queryInt64(c, "limit")
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return ErrBadReqeust
+		}
+	}
+
+	items := make([]map[string]interface{}, 0)
+	var next interface{}
+	if name := c.QueryParam("user"); name != "" {
+		u, err := store.GetUserByName(name)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"messages":    items,
+				"next_cursor": next,
+			})
+		}
+		q.userID = u.ID
+	}
+
+	// one more than asked for tells whether there is a next page; hits that
+	// fail the recheck are made up for with another round below the last ID
+	want := int(limit) + 1
+	found := make([]*Message, 0, want)
+	for len(found) < want {
+		n := want - len(found)
+		ids := ss.idx.Search(q, n)
+		for _, id := range ids {
+			m, err := store.GetMessage(id)
+			if err != nil {
+				return err
+			}
+			if m == nil || m.Deleted() || !matches(m.Content, text) {
+				continue
+			}
+			found = append(found, m)
+		}
+		if len(ids) < n {
+			break
+		}
+		q.before = ids[len(ids)-1]
+	}
+	if len(found) > int(limit) {
+		found = found[:limit]
+		next = found[limit-1].ID
+	}
+
+	for _, m := range found {
+		r, err := jsonifyMessage(m)
+		if err != nil {
+			return err
+		}
+		r["channel_id"] = m.ChannelID
+		items = append(items, r)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"messages":    items,
+		"next_cursor": next,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in       string
+		unigrams bool
+		want     []string
+	}{
+		{"", false, []string{}},
+		{"Hello, World!", false, []string{"hello", "world"}},
+		{"Ｇｏ言語", false, []string{"go", "言語"}},
+		{"日本語", false, []string{"日本", "本語"}},
+		{"日本語", true, []string{"日", "本", "語", "日本", "本語"}},
+		{"猫", false, []string{"猫"}},
+		{"isucon7予選", false, []string{"isucon7", "予選"}},
+		{"ラーメン", false, []string{"ラー", "ーメ", "メン"}},
+		{"a-b_c", false, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.in, tt.unigrams); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q, %v) = %q, want %q", tt.in, tt.unigrams, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		content, q string
+		want       bool
+	}{
+		{"hello world", "hello,", true},
+		{"hello, world", "world hello", true},
+		{"Ｈｅｌｌｏ", "hello", true},
+		{"東京都", "東京", true},
+		{"東京都", "京都", true},
+		{"東京都", "東京都", true},
+		{"東京の京都", "東京都", false},
+		{"京都と東京", "東京都", false},
+		{"日本語です", "本語で", true},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.content, tt.q); got != tt.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tt.content, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	now := time.Now()
+	x := newSearchIndex()
+	for _, m := range []*Message{
+		{ID: 1, ChannelID: 1, UserID: 1, Content: "hello world"},
+		{ID: 2, ChannelID: 1, UserID: 2, Content: "hello, there"},
+		{ID: 3, ChannelID: 2, UserID: 1, Content: "Hello again world"},
+		{ID: 4, ChannelID: 2, UserID: 2, Content: "東京都に住む"},
+		{ID: 5, ChannelID: 1, UserID: 1, Content: "world only"},
+		{ID: 6, ChannelID: 1, UserID: 1, Content: "hello gone", DeletedAt: &now},
+		{ID: 7, ChannelID: 1, UserID: 1, Content: "hello"},
+	} {
+		x.Put(m)
+	}
+	x.Put(&Message{ID: 7, ChannelID: 1, UserID: 1, Content: "edited"})
+
+	terms := func(s string) []string { return uniqueTerms(tokenize(s, false)) }
+	tests := []struct {
+		name  string
+		q     searchQuery
+		limit int
+		want  []int64
+	}{
+		{"one term", searchQuery{terms: terms("hello")}, 10, []int64{3, 2, 1}},
+		{"all terms", searchQuery{terms: terms("hello world")}, 10, []int64{3, 1}},
+		{"unknown term", searchQuery{terms: terms("hello nobody")}, 10, []int64{}},
+		{"no terms", searchQuery{}, 10, []int64{}},
+		{"edited away", searchQuery{terms: terms("edited")}, 10, []int64{7}},
+		{"limit", searchQuery{terms: terms("hello")}, 2, []int64{3, 2}},
+		{"before", searchQuery{terms: terms("hello"), before: 3}, 10, []int64{2, 1}},
+		{"before and limit", searchQuery{terms: terms("hello"), before: 3}, 1, []int64{2}},
+		{"after", searchQuery{terms: terms("hello"), after: 1}, 10, []int64{3, 2}},
+		{"channel", searchQuery{terms: terms("hello"), channelID: 1}, 10, []int64{2, 1}},
+		{"user", searchQuery{terms: terms("world"), userID: 1}, 10, []int64{5, 3, 1}},
+		{"bigrams", searchQuery{terms: terms("東京都")}, 10, []int64{4}},
+		{"unigram", searchQuery{terms: terms("住")}, 10, []int64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.q
+			if got := x.Search(&q, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Search = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+)
+
+// Sessions live in Redis, which every app server shares, so logging out or
+// revoking a session takes effect everywhere at once. The cookie holds an
+// opaque token signed with the first key of ISUBATA_SESSION_KEYS; the other
+// keys are still accepted so the key can be rotated without logging everyone
+// out, and cookies signed with them are re-signed on the next request.
+const (
+	sessionCookie   = "session"
+	sessionTTL      = 100 * time.Hour
+	sessionTouchGap = time.Minute
+	sessionCtxKey   = "session"
+
+	// sessionRecheck is how often /ws and /stream look for a revoked session.
+	sessionRecheck = 30 * time.Second
+)
+
+var sessionKeys [][]byte
+
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	UserID    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+
+	token string
+}
+
+func initSessionKeys() {
+	for _, k := range strings.Split(os.Getenv("ISUBATA_SESSION_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			sessionKeys = append(sessionKeys, []byte(k))
+		}
+	}
+	// a key made up here would differ on every app server behind the
+	// load balancer, so a login would only work on the one that made it
+	if len(sessionKeys) == 0 {
+		log.Fatal("session: ISUBATA_SESSION_KEYS is not set; put it in /home/isucon/secret.env")
+	}
+}
+
+func sessionKey(token string) string {
+	return "session:" + token
+}
+
+func userSessionsKey(userID int64) string {
+	return "sessions:user:" + strconv.FormatInt(userID, 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func signToken(key []byte, token string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookie returns the token in v and whether it was signed with an
+// older key.
+func verifyCookie(v string) (string, bool, bool) {
+	i := strings.LastIndexByte(v, '.')
+	if i < 0 {
+		return "", false, false
+	}
+	token, sig := v[:i], v[i+1:]
+	for n, k := range sessionKeys {
+		if hmac.Equal([]byte(sig), []byte(signToken(k, token))) {
+			return token, n > 0, true
+		}
+	}
+	return "", false, false
+}
+
+func setSessionCookie(c echo.Context, token string) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    token + "." + signToken(sessionKeys[0], token),
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+	})
+}
+
+func clearSessionCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+func loadSession(token string) (*sessionInfo, error) {
+	b, err := redisClient.Get(sessionKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &sessionInfo{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	s.token = token
+	return s, nil
+}
+
+func saveSession(s *sessionInfo) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	pipe := redisClient.TxPipeline()
+	pipe.Set(sessionKey(s.token), b, sessionTTL)
+	pipe.HSet(userSessionsKey(s.UserID), s.ID, s.token)
+	pipe.Expire(userSessionsKey(s.UserID), sessionTTL)
+	_, err = pipe.Exec()
+	return err
+}
+
+// touchSession stores the new LastSeen of s. It only overwrites a session
+// that still exists, so a touch racing a revoke can't bring it back.
+func touchSession(s *sessionInfo) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	pipe := redisClient.TxPipeline()
+	pipe.SetXX(sessionKey(s.token), b, sessionTTL)
+	pipe.Expire(userSessionsKey(s.UserID), sessionTTL)
+	_, err = pipe.Exec()
+	return err
+}
+
+// sessionAlive tells whether s hasn't been revoked. If Redis can't say, it
+// is taken to be alive rather than dropping every connection.
+func sessionAlive(s *sessionInfo) bool {
+	n, err := redisClient.Exists(sessionKey(s.token)).Result()
+	if err != nil {
+		log.Printf("session: %v", err)
+		return true
+	}
+	return n > 0
+}
+
+func revokeSession(s *sessionInfo) error {
+	pipe := redisClient.TxPipeline()
+	pipe.Del(sessionKey(s.token))
+	pipe.HDel(userSessionsKey(s.UserID), s.ID)
+	_, err := pipe.Exec()
+	return err
+}
+
+// currentSession returns the session of the request, or nil. The result is
+// cached on the context.
+func currentSession(c echo.Context) *sessionInfo {
+	if v := c.Get(sessionCtxKey); v != nil {
+		s, _ := v.(*sessionInfo)
+		return s
+	}
+	var s *sessionInfo
+	defer func() { c.Set(sessionCtxKey, s) }()
+
+	ck, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	token, stale, ok := verifyCookie(ck.Value)
+	if !ok {
+		return nil
+	}
+	s, err = loadSession(token)
+	if err != nil {
+		log.Printf("session: %v", err)
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	if stale {
+		setSessionCookie(c, token)
+	}
+	if now := time.Now(); now.Sub(s.LastSeen) > sessionTouchGap {
+		s.LastSeen = now
+		s.IP = clientIP(c)
+		if err := touchSession(s); err != nil {
+			log.Printf("session: %v", err)
+		}
+	}
+	return s
+}
+
+func sessUserID(c echo.Context) int64 {
+	if s := currentSession(c); s != nil {
+		return s.UserID
+	}
+	return 0
+}
+
+// sessSetUserID starts a new session for id. Any session the request came
+// with is revoked, so a token planted before login is useless afterwards.
+func sessSetUserID(c echo.Context, id int64) {
+	if old := currentSession(c); old != nil {
+		if err := revokeSession(old); err != nil {
+			log.Printf("session: %v", err)
+		}
+	}
+	now := time.Now()
+	s := &sessionInfo{
+		ID:        randomHex(8),
+		UserID:    id,
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        clientIP(c),
+		UserAgent: c.Request().UserAgent(),
+		token:     randomHex(32),
+	}
+	if err := saveSession(s); err != nil {
+		log.Printf("session: %v", err)
+		return
+	}
+	setSessionCookie(c, s.token)
+	c.Set(sessionCtxKey, s)
+}
+
+// sessClear revokes the session of the request and drops its cookie.
+func sessClear(c echo.Context) {
+	if s := currentSession(c); s != nil {
+		if err := revokeSession(s); err != nil {
+			log.Printf("session: %v", err)
+		}
+	}
+	clearSessionCookie(c)
+	c.Set(sessionCtxKey, (*sessionInfo)(nil))
+}
+
+// listSessions returns the live sessions of userID, most recently used first.
+func listSessions(userID int64) ([]*sessionInfo, error) {
+	h, err := redisClient.HGetAll(userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*sessionInfo, 0, len(h))
+	for id, token := range h {
+		s, err := loadSession(token)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			redisClient.HDel(userSessionsKey(userID), id)
+			continue
+		}
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+	return res, nil
+}
+
+func revokeAllSessions(userID int64) error {
+	ss, err := listSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if err := revokeSession(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postLogoutAll serves POST /logout_all, which logs the user out everywhere.
+func postLogoutAll(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	if err := revokeAllSessions(userID); err != nil {
+		return err
+	}
+	clearSessionCookie(c)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func getSessions(c echo.Context) error {
+	cur := currentSession(c)
+	if cur == nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+	ss, err := listSessions(cur.UserID)
+	if err != nil {
+		return err
+	}
+	res := make([]map[string]interface{}, 0, len(ss))
+	for _, s := range ss {
+		res = append(res, map[string]interface{}{
+			"id":         s.ID,
+			"created_at": s.CreatedAt,
+			"last_seen":  s.LastSeen,
+			"ip":         s.IP,
+			"user_agent": s.UserAgent,
+			"current":    s.ID == cur.ID,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// deleteSession serves DELETE /sessions/:id, which logs out one device.
+func deleteSession(c echo.Context) error {
+	cur := currentSession(c)
+	if cur == nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+	ss, err := listSessions(cur.UserID)
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if s.ID != c.Param("id") {
+			continue
+		}
+		if err := revokeSession(s); err != nil {
+			return err
+		}
+		if s.ID == cur.ID {
+			clearSessionCookie(c)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+	return echo.ErrNotFound
+}
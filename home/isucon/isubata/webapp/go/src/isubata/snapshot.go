@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	snapshotMetaKey      = "snapshot:meta"
+	snapshotUsersKey     = "snapshot:users"
+	snapshotChannelsKey  = "snapshot:channels"
+	snapshotMessagesKey  = "snapshot:messages"
+	snapshotReactionsKey = "snapshot:reactions"
+)
+
+var errSnapshotTorn = errors.New("snapshot epoch changed while restoring")
+
+// snapshotStore remembers which entities changed since the last snapshot so
+// that only those are written to Redis.
+type snapshotStore struct {
+	Store
+
+	full  bool
+	dirty snapshotDirty
+	m     sync.Mutex
+}
+
+// snapshotDirty is the set of IDs of each kind changed since the last save.
+type snapshotDirty struct {
+	users     map[int64]struct{}
+	channels  map[int64]struct{}
+	messages  map[int64]struct{}
+	reactions map[int64]struct{}
+}
+
+func newSnapshotDirty() snapshotDirty {
+	return snapshotDirty{
+		users:     make(map[int64]struct{}),
+		channels:  make(map[int64]struct{}),
+		messages:  make(map[int64]struct{}),
+		reactions: make(map[int64]struct{}),
+	}
+}
+
+func (d snapshotDirty) merge(o snapshotDirty) {
+	for _, p := range [][2]map[int64]struct{}{
+		{d.users, o.users},
+		{d.channels, o.channels},
+		{d.messages, o.messages},
+		{d.reactions, o.reactions},
+	} {
+		for id := range p[1] {
+			p[0][id] = struct{}{}
+		}
+	}
+}
+
+func newSnapshotStore(s Store) *snapshotStore {
+	return &snapshotStore{
+		Store: s,
+		dirty: newSnapshotDirty(),
+	}
+}
+
+func (s *snapshotStore) mark(set map[int64]struct{}, id int64) {
+	s.m.Lock()
+	set[id] = struct{}{}
+	s.m.Unlock()
+}
+
+func (s *snapshotStore) Reset() error {
+	if err := s.Store.Reset(); err != nil {
+		return err
+	}
+	s.m.Lock()
+	s.full = true
+	s.m.Unlock()
+	return nil
+}
+
+func (s *snapshotStore) PutUser(u *User) error {
+	if err := s.Store.PutUser(u); err != nil {
+		return err
+	}
+	s.mark(s.dirty.users, u.ID)
+	return nil
+}
+
+func (s *snapshotStore) AddUser(u *User) error {
+	if err := s.Store.AddUser(u); err != nil {
+		return err
+	}
+	s.mark(s.dirty.users, u.ID)
+	return nil
+}
+
+func (s *snapshotStore) PutChannel(ch *Channel) error {
+	if err := s.Store.PutChannel(ch); err != nil {
+		return err
+	}
+	s.mark(s.dirty.channels, ch.ID)
+	return nil
+}
+
+func (s *snapshotStore) AddMessage(m *Message) error {
+	if err := s.Store.AddMessage(m); err != nil {
+		return err
+	}
+	s.mark(s.dirty.messages, m.ID)
+	return nil
+}
+
+func (s *snapshotStore) EditMessage(m *Message) error {
+	if err := s.Store.EditMessage(m); err != nil {
+		return err
+	}
+	s.mark(s.dirty.messages, m.ID)
+	return nil
+}
+
+func (s *snapshotStore) DeleteMessage(m *Message) error {
+	if err := s.Store.DeleteMessage(m); err != nil {
+		return err
+	}
+	s.mark(s.dirty.messages, m.ID)
+	return nil
+}
+
+func (s *snapshotStore) UpdateHaveRead(chanID, userID, messageID int64) error {
+	if err := s.Store.UpdateHaveRead(chanID, userID, messageID); err != nil {
+		return err
+	}
+	s.mark(s.dirty.channels, chanID)
+	return nil
+}
+
+func (s *snapshotStore) AddReaction(messageID, userID int64, emoji string) error {
+	if err := s.Store.AddReaction(messageID, userID, emoji); err != nil {
+		return err
+	}
+	s.mark(s.dirty.reactions, messageID)
+	return nil
+}
+
+func (s *snapshotStore) RemoveReaction(messageID, userID int64, emoji string) error {
+	if err := s.Store.RemoveReaction(messageID, userID, emoji); err != nil {
+		return err
+	}
+	s.mark(s.dirty.reactions, messageID)
+	return nil
+}
+
+func (s *snapshotStore) takeDirty() (bool, snapshotDirty) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	full, d := s.full, s.dirty
+	s.full = false
+	s.dirty = newSnapshotDirty()
+	return full, d
+}
+
+func (s *snapshotStore) putBack(full bool, d snapshotDirty) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.full = s.full || full
+	s.dirty.merge(d)
+}
+
+// Save writes everything changed since the previous call and bumps the epoch
+// in the same transaction, so a reader never sees half a generation.
+func (s *snapshotStore) Save() (int, error) {
+	full, d := s.takeDirty()
+	n, err := s.save(full, d)
+	if err != nil {
+		s.putBack(full, d)
+	}
+	return n, err
+}
+
+func (s *snapshotStore) save(full bool, dirty snapshotDirty) (int, error) {
+	users := make(map[string]interface{})
+	channels := make(map[string]interface{})
+	messages := make(map[string]interface{})
+	reactions := make(map[string]interface{})
+	unreacted := make([]string, 0)
+
+	if full {
+		d, err := s.Store.Dump()
+		if err != nil {
+			return 0, err
+		}
+		for id, u := range d.Users {
+			if err := putGob(users, id, u); err != nil {
+				return 0, err
+			}
+		}
+		for id, ch := range d.Channels {
+			if err := putGob(channels, id, ch); err != nil {
+				return 0, err
+			}
+		}
+		for id, m := range d.Messages {
+			if err := putGob(messages, id, m); err != nil {
+				return 0, err
+			}
+		}
+		for id, rs := range d.Reactions {
+			if err := putGob(reactions, id, rs); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		for id := range dirty.users {
+			u, err := s.Store.GetUser(id)
+			if err != nil {
+				return 0, err
+			}
+			if u == nil {
+				continue
+			}
+			if err := putGob(users, id, u); err != nil {
+				return 0, err
+			}
+		}
+		for id := range dirty.channels {
+			ch, err := s.Store.GetChannel(id)
+			if err != nil {
+				return 0, err
+			}
+			if ch == nil {
+				continue
+			}
+			if err := putGob(channels, id, ch.Clone()); err != nil {
+				return 0, err
+			}
+		}
+		for id := range dirty.messages {
+			m, err := s.Store.GetMessage(id)
+			if err != nil {
+				return 0, err
+			}
+			if m == nil {
+				continue
+			}
+			if err := putGob(messages, id, m); err != nil {
+				return 0, err
+			}
+		}
+		for id := range dirty.reactions {
+			rs, err := s.Store.GetReactions(id)
+			if err != nil {
+				return 0, err
+			}
+			if len(rs) == 0 {
+				unreacted = append(unreacted, strconv.FormatInt(id, 10))
+				continue
+			}
+			if err := putGob(reactions, id, rs); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n := len(users) + len(channels) + len(messages) + len(reactions) + len(unreacted)
+	if n == 0 && !full {
+		return 0, nil
+	}
+
+	pipe := redisClient.TxPipeline()
+	if full {
+		pipe.Del(snapshotUsersKey, snapshotChannelsKey, snapshotMessagesKey, snapshotReactionsKey)
+	}
+	if len(users) > 0 {
+		pipe.HMSet(snapshotUsersKey, users)
+	}
+	if len(channels) > 0 {
+		pipe.HMSet(snapshotChannelsKey, channels)
+	}
+	if len(messages) > 0 {
+		pipe.HMSet(snapshotMessagesKey, messages)
+	}
+	if len(reactions) > 0 {
+		pipe.HMSet(snapshotReactionsKey, reactions)
+	}
+	if len(unreacted) > 0 {
+		pipe.HDel(snapshotReactionsKey, unreacted...)
+	}
+	pipe.HIncrBy(snapshotMetaKey, "epoch", 1)
+	pipe.HMSet(snapshotMetaKey, map[string]interface{}{
+		"saved_at": time.Now().Unix(),
+	})
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *snapshotStore) saveLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n, err := s.Save()
+		if err != nil {
+			log.Println("failed to save snapshot:", err)
+			continue
+		}
+		log.Printf("saved snapshot: %d entities", n)
+	}
+}
+
+func putGob(h map[string]interface{}, id int64, v interface{}) error {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	h[strconv.FormatInt(id, 10)] = buf.Bytes()
+	return nil
+}
+
+func snapshotEpoch() (int64, error) {
+	v, err := redisClient.HGet(snapshotMetaKey, "epoch").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// loadSnapshot reads the per-entity snapshot. It returns a nil Dump if no
+// snapshot has been written in this format yet.
+func loadSnapshot() (*Dump, int64, error) {
+	for i := 0; i < 3; i++ {
+		d, epoch, err := loadSnapshotOnce()
+		if err == errSnapshotTorn {
+			log.Println("snapshot was updated while restoring, retrying")
+			continue
+		}
+		return d, epoch, err
+	}
+	return nil, 0, errSnapshotTorn
+}
+
+func loadSnapshotOnce() (*Dump, int64, error) {
+	epoch, err := snapshotEpoch()
+	if err != nil {
+		return nil, 0, err
+	}
+	if epoch == 0 {
+		return nil, 0, nil
+	}
+
+	d := &Dump{
+		Users:     make(map[int64]*User),
+		Channels:  make(map[int64]*Channel),
+		Messages:  make(map[int64]*Message),
+		Reactions: make(map[int64]MessageReactions),
+	}
+	err = loadSnapshotHash(snapshotUsersKey, func(id int64, b []byte) error {
+		u := &User{}
+		d.Users[id] = u
+		return gob.NewDecoder(bytes.NewBuffer(b)).Decode(u)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	err = loadSnapshotHash(snapshotChannelsKey, func(id int64, b []byte) error {
+		ch := &Channel{}
+		d.Channels[id] = ch
+		return gob.NewDecoder(bytes.NewBuffer(b)).Decode(ch)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	err = loadSnapshotHash(snapshotMessagesKey, func(id int64, b []byte) error {
+		m := &Message{}
+		d.Messages[id] = m
+		return gob.NewDecoder(bytes.NewBuffer(b)).Decode(m)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	err = loadSnapshotHash(snapshotReactionsKey, func(id int64, b []byte) error {
+		rs := make(MessageReactions)
+		if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&rs); err != nil {
+			return err
+		}
+		d.Reactions[id] = rs
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	after, err := snapshotEpoch()
+	if err != nil {
+		return nil, 0, err
+	}
+	if after != epoch {
+		return nil, 0, errSnapshotTorn
+	}
+	return d, epoch, nil
+}
+
+func loadSnapshotHash(key string, f func(int64, []byte) error) error {
+	h, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return err
+	}
+	for k, v := range h {
+		id, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: bad field %q", key, k)
+		}
+		if err := f(id, []byte(v)); err != nil {
+			return fmt.Errorf("%s: %d: %v", key, id, err)
+		}
+	}
+	return nil
+}
+
+// loadLegacySnapshot reads the whole-world gob keys written by older builds.
+func loadLegacySnapshot() (*Dump, error) {
+	d := &Dump{
+		Users:    make(map[int64]*User),
+		Channels: make(map[int64]*Channel),
+		Messages: make(map[int64]*Message),
+	}
+
+	ub, err := redisClient.Get("users").Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore users: %v", err)
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(ub)).Decode(&d.Users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %v", err)
+	}
+
+	cb, err := redisClient.Get("channels").Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore channels: %v", err)
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(cb)).Decode(&d.Channels); err != nil {
+		return nil, fmt.Errorf("failed to decode channels: %v", err)
+	}
+
+	mb, err := redisClient.Get("messages").Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore messages: %v", err)
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(mb)).Decode(&d.Messages); err != nil {
+		return nil, fmt.Errorf("failed to decode messages: %v", err)
+	}
+	return d, nil
+}
+
+// restoreSnapshot loads the latest snapshot into s and returns its epoch,
+// which is 0 when it came from the legacy keys.
+func restoreSnapshot(s Store) (int64, error) {
+	d, epoch, err := loadSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	if d == nil {
+		if d, err = loadLegacySnapshot(); err != nil {
+			return 0, err
+		}
+		log.Println("restored legacy snapshot")
+	} else {
+		log.Printf("restored snapshot epoch %d", epoch)
+	}
+	return epoch, applyDump(s, d)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+type Store interface {
+	Reset() error
+
+	GetUser(id int64) (*User, error)
+	GetUserByName(name string) (*User, error)
+	ListUsers() ([]*User, error)
+	// AddUser stores a new user, or returns ErrNameTaken if another user
+	// already has its name.
+	AddUser(u *User) error
+	PutUser(u *User) error
+
+	GetChannel(id int64) (*Channel, error)
+	PutChannel(ch *Channel) error
+	ListChannels() ([]*Channel, error)
+
+	AddMessage(m *Message) error
+	// EditMessage stores m over the message with the same ID unless that
+	// one is deleted or was edited later than m.
+	EditMessage(m *Message) error
+	// DeleteMessage replaces a message with the tombstone m.
+	DeleteMessage(m *Message) error
+	GetMessage(id int64) (*Message, error)
+	// GetMessageRange returns the messages of chanID with IDs in [from, to),
+	// tombstones included, oldest first.
+	GetMessageRange(chanID, from, to int64) ([]*Message, error)
+	// GetMessagesAfter returns timeline messages newer than lastID, oldest
+	// first, and thread replies too if replies is set. A positive limit
+	// keeps only the newest limit of them.
+	GetMessagesAfter(chanID, lastID int64, limit int, replies bool) ([]*Message, error)
+	// GetThread returns the replies to parentID, oldest first.
+	GetThread(chanID, parentID int64) ([]*Message, error)
+	CountReplies(chanID, parentID int64) (int64, error)
+	// GetLatestMessages skips the newest offset timeline messages of a
+	// channel and returns up to limit of the ones before them, oldest first.
+	GetLatestMessages(chanID int64, offset, limit int) ([]*Message, error)
+	CountMessages(chanID int64) (int64, error)
+	GetMessagePage(chanID, after, before int64, limit int) (*MessagePage, error)
+
+	// GetMentions returns up to limit messages mentioning userID with an ID
+	// below before, newest first. A zero before means no upper bound.
+	GetMentions(userID, before int64, limit int) ([]*Message, error)
+	CountUnreadMentions(chanID, userID int64) (int64, error)
+
+	AddReaction(messageID, userID int64, emoji string) error
+	RemoveReaction(messageID, userID int64, emoji string) error
+	GetReactions(messageID int64) (MessageReactions, error)
+
+	UpdateHaveRead(chanID, userID, messageID int64) error
+	GetHaveRead(chanID, userID int64) (int64, error)
+	CountUnread(chanID, userID int64) (int64, error)
+
+	Dump() (*Dump, error)
+}
+
+// memStore is the memory store under store, if there is one.
+var memStore *memoryStore
+
+func newStore() Store {
+	switch os.Getenv("ISUBATA_STORE") {
+	case "mysql":
+		return newMySQLStore(db)
+	default:
+		return newMemoryStore()
+	}
+}
+
+type memoryStore struct {
+	users     map[int64]*User
+	byName    map[string]*User
+	channels  Channels
+	messages  Messages
+	reactions Reactions
+	mentions  Mentions
+	digest    *digestCache
+
+	m sync.RWMutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:  make(map[int64]*User),
+		byName: make(map[string]*User),
+		digest: newDigestCache(),
+	}
+}
+
+func (s *memoryStore) clear() {
+	s.m.Lock()
+	s.users = make(map[int64]*User)
+	s.byName = make(map[string]*User)
+	s.m.Unlock()
+	s.channels.Clear()
+	s.messages.Clear()
+	s.reactions.Reset()
+	s.mentions.Reset()
+	s.digest.reset()
+}
+
+func (s *memoryStore) Reset() error {
+	s.clear()
+
+	if err := s.initializeUsers(); err != nil {
+		return err
+	}
+	if err := s.initializeChannels(); err != nil {
+		return err
+	}
+	if err := s.initializeMessages(); err != nil {
+		return err
+	}
+	return nil
+}
+
+type storeStats struct {
+	Users, Channels, Messages             int
+	MaxUserID, MaxChannelID, MaxMessageID int64
+}
+
+func (s *memoryStore) Stats() storeStats {
+	st := storeStats{}
+	s.m.RLock()
+	for id := range s.users {
+		st.Users++
+		if id > st.MaxUserID {
+			st.MaxUserID = id
+		}
+	}
+	s.m.RUnlock()
+	s.channels.Range(func(id int64, _ *Channel) bool {
+		st.Channels++
+		if id > st.MaxChannelID {
+			st.MaxChannelID = id
+		}
+		return true
+	})
+	s.messages.Range(func(id int64, _ *Message) bool {
+		st.Messages++
+		if id > st.MaxMessageID {
+			st.MaxMessageID = id
+		}
+		return true
+	})
+	return st
+}
+
+func (s *memoryStore) GetUser(id int64) (*User, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.users[id], nil
+}
+
+func (s *memoryStore) GetUserByName(name string) (*User, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.byName[name], nil
+}
+
+func (s *memoryStore) AddUser(u *User) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if cur := s.byName[u.Name]; cur != nil && cur.ID != u.ID {
+		return ErrNameTaken
+	}
+	s.putUser(u)
+	return nil
+}
+
+func (s *memoryStore) PutUser(u *User) error {
+	s.m.Lock()
+	s.putUser(u)
+	s.m.Unlock()
+	return nil
+}
+
+// putUser stores u and points its name at it, unless the stored copy was
+// updated later. Replicas can bring in two users with the same name; the one
+// with the lower ID keeps the name, so every node resolves it the same way.
+// The caller holds s.m.
+func (s *memoryStore) putUser(u *User) {
+	old := s.users[u.ID]
+	if old != nil && old.UpdatedAt.After(u.UpdatedAt) {
+		return
+	}
+	if old != nil && old.Name != u.Name && s.byName[old.Name] == old {
+		delete(s.byName, old.Name)
+	}
+	if old == nil {
+		s.digest.addUser(u)
+	} else {
+		s.digest.replaceUser(old, u)
+	}
+	s.users[u.ID] = u
+	if cur := s.byName[u.Name]; cur == nil || cur.ID >= u.ID {
+		s.byName[u.Name] = u
+	}
+}
+
+func (s *memoryStore) ListUsers() ([]*User, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	res := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		res = append(res, u)
+	}
+	return res, nil
+}
+
+func (s *memoryStore) GetChannel(id int64) (*Channel, error) {
+	return s.channels.Load(id), nil
+}
+
+func (s *memoryStore) PutChannel(ch *Channel) error {
+	if cur := s.channels.Load(ch.ID); cur != nil {
+		cur.m.Lock()
+		cur.Name = ch.Name
+		cur.Description = ch.Description
+		cur.UpdatedAt = ch.UpdatedAt
+		cur.m.Unlock()
+		return nil
+	}
+	if _, loaded := s.channels.LoadOrStore(ch.ID, ch); !loaded {
+		s.digest.addChannel(ch.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListChannels() ([]*Channel, error) {
+	return s.channels.Slice(), nil
+}
+
+func (s *memoryStore) AddMessage(m *Message) error {
+	ch := s.channels.Load(m.ChannelID)
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	if m.User == nil {
+		m.User, _ = s.GetUser(m.UserID)
+	}
+	ch.m.Lock()
+	if _, loaded := s.messages.LoadOrStore(m.ID, m); loaded {
+		ch.m.Unlock()
+		return nil
+	}
+	s.digest.addMessage(m)
+	if m.Deleted() {
+		ch.m.Unlock()
+		return nil
+	}
+	ch.insert(m)
+	ch.m.Unlock()
+	s.mentions.Add(m)
+	notifyNewMessage(m)
+	return nil
+}
+
+func (s *memoryStore) EditMessage(m *Message) error {
+	ch := s.channels.Load(m.ChannelID)
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	if m.User == nil {
+		m.User, _ = s.GetUser(m.UserID)
+	}
+	ch.m.Lock()
+	cur := s.messages.Load(m.ID)
+	if cur == nil {
+		// The edit overtook the message itself.
+		s.messages.Store(m.ID, m)
+		s.digest.addMessage(m)
+		ch.insert(m)
+		ch.m.Unlock()
+		s.mentions.Add(m)
+		notifyNewMessage(m)
+		return nil
+	}
+	if cur.Deleted() || (cur.EditedAt != nil && (m.EditedAt == nil || !m.EditedAt.After(*cur.EditedAt))) {
+		ch.m.Unlock()
+		return nil
+	}
+	s.messages.Store(m.ID, m)
+	s.digest.replaceMessage(cur, m)
+	ch.replace(m)
+	s.mentions.Update(cur, m)
+	ch.m.Unlock()
+	unreadNotifier.NotifyAll()
+	return nil
+}
+
+func (s *memoryStore) DeleteMessage(m *Message) error {
+	ch := s.channels.Load(m.ChannelID)
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	ch.m.Lock()
+	cur := s.messages.Load(m.ID)
+	if cur != nil && cur.Deleted() {
+		ch.m.Unlock()
+		return nil
+	}
+	s.messages.Store(m.ID, m)
+	if cur == nil {
+		s.digest.addMessage(m)
+	} else {
+		s.digest.replaceMessage(cur, m)
+	}
+	removed := cur != nil && ch.remove(cur)
+	ch.m.Unlock()
+	if removed {
+		s.mentions.Remove(cur)
+		unreadNotifier.NotifyAll()
+	}
+	return nil
+}
+
+func (s *memoryStore) GetMessage(id int64) (*Message, error) {
+	return s.messages.Load(id), nil
+}
+
+func (s *memoryStore) GetMessageRange(chanID, from, to int64) ([]*Message, error) {
+	res := make([]*Message, 0)
+	for id := from; id < to; id++ {
+		if m := s.messages.Load(id); m != nil && m.ChannelID == chanID {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryStore) GetMessagesAfter(chanID, lastID int64, limit int, replies bool) ([]*Message, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return nil, ErrChannelNotFound
+	}
+	return ch.GetMessagesAfter(lastID, limit, replies), nil
+}
+
+func (s *memoryStore) GetThread(chanID, parentID int64) ([]*Message, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return nil, ErrChannelNotFound
+	}
+	return ch.Thread(parentID), nil
+}
+
+func (s *memoryStore) CountReplies(chanID, parentID int64) (int64, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return 0, ErrChannelNotFound
+	}
+	return int64(ch.CountReplies(parentID)), nil
+}
+
+func (s *memoryStore) GetLatestMessages(chanID int64, offset, limit int) ([]*Message, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return nil, ErrChannelNotFound
+	}
+	return ch.Latest(offset, limit), nil
+}
+
+func (s *memoryStore) GetMessagePage(chanID, after, before int64, limit int) (*MessagePage, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return nil, ErrChannelNotFound
+	}
+	return ch.Page(after, before, limit), nil
+}
+
+func (s *memoryStore) CountMessages(chanID int64) (int64, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return 0, ErrChannelNotFound
+	}
+	return int64(ch.Len()), nil
+}
+
+func (s *memoryStore) GetMentions(userID, before int64, limit int) ([]*Message, error) {
+	ids := s.mentions.Before(userID, before, limit)
+	res := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		if m := s.messages.Load(id); m != nil && !m.Deleted() {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryStore) CountUnreadMentions(chanID, userID int64) (int64, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return 0, ErrChannelNotFound
+	}
+	return int64(s.mentions.CountAfter(userID, chanID, ch.GetHaveRead(userID))), nil
+}
+
+func (s *memoryStore) AddReaction(messageID, userID int64, emoji string) error {
+	if s.reactions.Add(messageID, userID, emoji) {
+		s.digest.toggleReaction(messageID, userID, emoji)
+	}
+	return nil
+}
+
+func (s *memoryStore) RemoveReaction(messageID, userID int64, emoji string) error {
+	if s.reactions.Remove(messageID, userID, emoji) {
+		s.digest.toggleReaction(messageID, userID, emoji)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetReactions(messageID int64) (MessageReactions, error) {
+	return s.reactions.Get(messageID), nil
+}
+
+func (s *memoryStore) UpdateHaveRead(chanID, userID, messageID int64) error {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+	ch.UpdateHaveRead(userID, messageID)
+	return nil
+}
+
+func (s *memoryStore) GetHaveRead(chanID, userID int64) (int64, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return 0, ErrChannelNotFound
+	}
+	return ch.GetHaveRead(userID), nil
+}
+
+func (s *memoryStore) CountUnread(chanID, userID int64) (int64, error) {
+	ch := s.channels.Load(chanID)
+	if ch == nil {
+		return 0, ErrChannelNotFound
+	}
+	return ch.CountAfter(ch.GetHaveRead(userID)), nil
+}
+
+func (s *memoryStore) Dump() (*Dump, error) {
+	s.m.RLock()
+	us := make(map[int64]*User, len(s.users))
+	for k, v := range s.users {
+		us[k] = v
+	}
+	s.m.RUnlock()
+	chs := make(map[int64]*Channel)
+	s.channels.Range(func(id int64, ch *Channel) bool {
+		chs[id] = ch.Clone()
+		return true
+	})
+	return &Dump{
+		Users:     us,
+		Channels:  chs,
+		Messages:  s.messages.Hash(),
+		Reactions: s.reactions.Hash(),
+	}, nil
+}
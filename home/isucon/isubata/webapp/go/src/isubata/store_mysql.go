@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// The columns and tables this store needs on top of the original schema are
+// in db/store_mysql.sql.
+
+// messageColumns are the message columns read into a Message.
+const messageColumns = "id, channel_id, user_id, content, created_at, parent_id, edited_at, deleted_at"
+
+type mysqlStore struct {
+	db *sqlx.DB
+}
+
+func newMySQLStore(db *sqlx.DB) *mysqlStore {
+	return &mysqlStore{db: db}
+}
+
+func (s *mysqlStore) Reset() error {
+	return nil
+}
+
+func (s *mysqlStore) GetUser(id int64) (*User, error) {
+	var u User
+	err := s.db.Get(&u, "SELECT * FROM user WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *mysqlStore) Stats() (storeStats, error) {
+	st := storeStats{}
+	for _, t := range []struct {
+		table string
+		n     *int
+		maxID *int64
+	}{
+		{"user", &st.Users, &st.MaxUserID},
+		{"channel", &st.Channels, &st.MaxChannelID},
+		{"message", &st.Messages, &st.MaxMessageID},
+	} {
+		err := s.db.QueryRow("SELECT COUNT(*), COALESCE(MAX(id), 0) FROM "+t.table).Scan(t.n, t.maxID)
+		if err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+func (s *mysqlStore) ListUsers() ([]*User, error) {
+	us := make([]*User, 0)
+	if err := s.db.Select(&us, "SELECT * FROM user"); err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+func (s *mysqlStore) GetUserByName(name string) (*User, error) {
+	var u User
+	err := s.db.Get(&u, "SELECT * FROM user WHERE name = ?", name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// AddUser leans on the unique key on user.name.
+func (s *mysqlStore) AddUser(u *User) error {
+	_, err := s.db.Exec(
+		"INSERT INTO user (id, name, salt, password, display_name, avatar_icon, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		u.ID, u.Name, u.Salt, u.Password, u.DisplayName, u.AvatarIcon, u.CreatedAt)
+	if me, ok := err.(*mysql.MySQLError); ok && me.Number == 1062 {
+		return ErrNameTaken
+	}
+	return err
+}
+
+func (s *mysqlStore) PutUser(u *User) error {
+	_, err := s.db.Exec(
+		"INSERT INTO user (id, name, salt, password, display_name, avatar_icon, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE name = VALUES(name), salt = VALUES(salt), password = VALUES(password),"+
+			" display_name = VALUES(display_name), avatar_icon = VALUES(avatar_icon)",
+		u.ID, u.Name, u.Salt, u.Password, u.DisplayName, u.AvatarIcon, u.CreatedAt)
+	return err
+}
+
+func (s *mysqlStore) GetChannel(id int64) (*Channel, error) {
+	var c Channel
+	err := s.db.QueryRow("SELECT id, name, description, updated_at, created_at FROM channel WHERE id = ?", id).
+		Scan(&c.ID, &c.Name, &c.Description, &c.UpdatedAt, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *mysqlStore) PutChannel(ch *Channel) error {
+	_, err := s.db.Exec(
+		"INSERT INTO channel (id, name, description, updated_at, created_at) VALUES (?, ?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE name = VALUES(name), description = VALUES(description), updated_at = VALUES(updated_at)",
+		ch.ID, ch.Name, ch.Description, ch.UpdatedAt, ch.CreatedAt)
+	return err
+}
+
+func (s *mysqlStore) ListChannels() ([]*Channel, error) {
+	rows, err := s.db.Query("SELECT id, name, description, updated_at, created_at FROM channel ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*Channel, 0)
+	for rows.Next() {
+		var c Channel
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.UpdatedAt, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, &c)
+	}
+	return res, rows.Err()
+}
+
+// checkChannel returns ErrChannelNotFound for an unknown channel, as the
+// memory store does; MySQL has no foreign key to do it.
+func (s *mysqlStore) checkChannel(id int64) error {
+	var n int
+	err := s.db.Get(&n, "SELECT 1 FROM channel WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return ErrChannelNotFound
+	}
+	return err
+}
+
+func (s *mysqlStore) AddMessage(m *Message) error {
+	if err := s.checkChannel(m.ChannelID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO message ("+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		m.ID, m.ChannelID, m.UserID, m.Content, m.CreatedAt, m.ParentID, m.EditedAt, m.DeletedAt)
+	if err != nil {
+		return err
+	}
+	for _, userID := range m.Mentions {
+		_, err := s.db.Exec("INSERT IGNORE INTO mention (message_id, user_id, channel_id) VALUES (?, ?, ?)",
+			m.ID, userID, m.ChannelID)
+		if err != nil {
+			return err
+		}
+	}
+	if !m.Deleted() {
+		notifyNewMessage(m)
+	}
+	return nil
+}
+
+func (s *mysqlStore) EditMessage(m *Message) error {
+	if err := s.checkChannel(m.ChannelID); err != nil {
+		return err
+	}
+	const newer = "deleted_at IS NULL AND (edited_at IS NULL OR edited_at < VALUES(edited_at))"
+	r, err := s.db.Exec(
+		"INSERT INTO message ("+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, NULL)"+
+			" ON DUPLICATE KEY UPDATE content = IF("+newer+", VALUES(content), content),"+
+			" edited_at = IF("+newer+", VALUES(edited_at), edited_at)",
+		m.ID, m.ChannelID, m.UserID, m.Content, m.CreatedAt, m.ParentID, m.EditedAt)
+	if err != nil {
+		return err
+	}
+	// no rows affected means the edit lost to a later one or a delete
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return s.updateMentions(m)
+}
+
+// updateMentions makes the mention rows of m match m.Mentions.
+func (s *mysqlStore) updateMentions(m *Message) error {
+	q := "DELETE FROM mention WHERE message_id = ?"
+	args := []interface{}{m.ID}
+	if len(m.Mentions) > 0 {
+		q += " AND user_id NOT IN (?" + strings.Repeat(", ?", len(m.Mentions)-1) + ")"
+		for _, userID := range m.Mentions {
+			args = append(args, userID)
+		}
+	}
+	if _, err := s.db.Exec(q, args...); err != nil {
+		return err
+	}
+	for _, userID := range m.Mentions {
+		_, err := s.db.Exec("INSERT IGNORE INTO mention (message_id, user_id, channel_id) VALUES (?, ?, ?)",
+			m.ID, userID, m.ChannelID)
+		if err != nil {
+			return err
+		}
+	}
+	unreadNotifier.NotifyAll()
+	return nil
+}
+
+func (s *mysqlStore) DeleteMessage(m *Message) error {
+	if err := s.checkChannel(m.ChannelID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		"INSERT INTO message ("+messageColumns+") VALUES (?, ?, ?, '', ?, ?, NULL, ?)"+
+			" ON DUPLICATE KEY UPDATE content = '', deleted_at = IFNULL(deleted_at, VALUES(deleted_at))",
+		m.ID, m.ChannelID, m.UserID, m.CreatedAt, m.ParentID, m.DeletedAt)
+	if err != nil {
+		return err
+	}
+	unreadNotifier.NotifyAll()
+	return nil
+}
+
+func (s *mysqlStore) GetMessage(id int64) (*Message, error) {
+	var m Message
+	err := s.db.Get(&m, "SELECT "+messageColumns+" FROM message WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fillMentions([]*Message{&m}); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *mysqlStore) GetMessagesAfter(chanID, lastID int64, limit int, replies bool) ([]*Message, error) {
+	q := "SELECT " + messageColumns + " FROM message WHERE channel_id = ? AND deleted_at IS NULL AND id > ?"
+	if !replies {
+		q += " AND parent_id = 0"
+	}
+	if limit <= 0 {
+		return s.selectMessages(q+" ORDER BY id", chanID, lastID)
+	}
+	res, err := s.selectMessages(q+" ORDER BY id DESC LIMIT ?", chanID, lastID, limit)
+	reverseMessages(res)
+	return res, err
+}
+
+func (s *mysqlStore) GetThread(chanID, parentID int64) ([]*Message, error) {
+	return s.selectMessages(
+		"SELECT "+messageColumns+" FROM message WHERE channel_id = ? AND parent_id = ? AND deleted_at IS NULL ORDER BY id",
+		chanID, parentID)
+}
+
+func (s *mysqlStore) GetMessageRange(chanID, from, to int64) ([]*Message, error) {
+	return s.selectMessages(
+		"SELECT "+messageColumns+" FROM message WHERE channel_id = ? AND id >= ? AND id < ? ORDER BY id",
+		chanID, from, to)
+}
+
+func (s *mysqlStore) CountReplies(chanID, parentID int64) (int64, error) {
+	var cnt int64
+	err := s.db.Get(&cnt, "SELECT COUNT(*) FROM message WHERE channel_id = ? AND parent_id = ? AND deleted_at IS NULL",
+		chanID, parentID)
+	return cnt, err
+}
+
+func (s *mysqlStore) GetLatestMessages(chanID int64, offset, limit int) ([]*Message, error) {
+	res, err := s.selectMessages(
+		"SELECT "+messageColumns+" FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL ORDER BY id DESC LIMIT ? OFFSET ?",
+		chanID, limit, offset)
+	reverseMessages(res)
+	return res, err
+}
+
+func (s *mysqlStore) CountMessages(chanID int64) (int64, error) {
+	var cnt int64
+	err := s.db.Get(&cnt, "SELECT COUNT(*) FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL", chanID)
+	return cnt, err
+}
+
+func (s *mysqlStore) GetMessagePage(chanID, after, before int64, limit int) (*MessagePage, error) {
+	q := "SELECT " + messageColumns + " FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL AND id > ?"
+	args := []interface{}{chanID, after}
+	if before > 0 {
+		q += " AND id < ?"
+		args = append(args, before)
+	}
+	backward := before > 0 || after == 0
+	if backward {
+		q += " ORDER BY id DESC LIMIT ?"
+	} else {
+		q += " ORDER BY id LIMIT ?"
+	}
+	args = append(args, limit+1)
+
+	ms, err := s.selectMessages(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	more := len(ms) > limit
+	if more {
+		ms = ms[:limit]
+	}
+	if backward {
+		reverseMessages(ms)
+	}
+	res := &MessagePage{Messages: ms}
+	if backward {
+		res.HasOlder = more
+	} else {
+		res.HasNewer = more
+	}
+
+	if len(ms) == 0 {
+		return res, nil
+	}
+	var n int
+	if backward {
+		err := s.db.Get(&n, "SELECT COUNT(*) FROM (SELECT 1 FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL AND id > ? LIMIT 1) t",
+			chanID, ms[len(ms)-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		res.HasNewer = n > 0
+	} else {
+		err := s.db.Get(&n, "SELECT COUNT(*) FROM (SELECT 1 FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL AND id < ? LIMIT 1) t",
+			chanID, ms[0].ID)
+		if err != nil {
+			return nil, err
+		}
+		res.HasOlder = n > 0
+	}
+	return res, nil
+}
+
+func (s *mysqlStore) selectMessages(q string, args ...interface{}) ([]*Message, error) {
+	res := make([]*Message, 0)
+	if err := s.db.Select(&res, q, args...); err != nil {
+		return nil, err
+	}
+	if err := s.fillMentions(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mentionRow is a row of the mention table.
+type mentionRow struct {
+	MessageID int64 `db:"message_id"`
+	UserID    int64 `db:"user_id"`
+}
+
+func (s *mysqlStore) fillMentions(ms []*Message) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Message, len(ms))
+	args := make([]interface{}, 0, len(ms))
+	for _, m := range ms {
+		byID[m.ID] = m
+		args = append(args, m.ID)
+	}
+	rows := make([]mentionRow, 0)
+	err := s.db.Select(&rows,
+		"SELECT message_id, user_id FROM mention WHERE message_id IN (?"+strings.Repeat(", ?", len(ms)-1)+") ORDER BY user_id",
+		args...)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		m := byID[r.MessageID]
+		m.Mentions = append(m.Mentions, r.UserID)
+	}
+	return nil
+}
+
+func (s *mysqlStore) GetMentions(userID, before int64, limit int) ([]*Message, error) {
+	q := "SELECT " + messageColumns + " FROM message WHERE deleted_at IS NULL" +
+		" AND id IN (SELECT message_id FROM mention WHERE user_id = ?)"
+	args := []interface{}{userID}
+	if before > 0 {
+		q += " AND id < ?"
+		args = append(args, before)
+	}
+	args = append(args, limit)
+	return s.selectMessages(q+" ORDER BY id DESC LIMIT ?", args...)
+}
+
+func (s *mysqlStore) CountUnreadMentions(chanID, userID int64) (int64, error) {
+	lastID, err := s.GetHaveRead(chanID, userID)
+	if err != nil {
+		return 0, err
+	}
+	var cnt int64
+	err = s.db.Get(&cnt,
+		"SELECT COUNT(*) FROM mention x JOIN message m ON m.id = x.message_id"+
+			" WHERE x.user_id = ? AND x.channel_id = ? AND x.message_id > ? AND m.deleted_at IS NULL",
+		userID, chanID, lastID)
+	return cnt, err
+}
+
+func reverseMessages(ms []*Message) {
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
+}
+
+// reactionRow is a row of the reaction table.
+type reactionRow struct {
+	MessageID int64  `db:"message_id"`
+	UserID    int64  `db:"user_id"`
+	Emoji     string `db:"emoji"`
+}
+
+func (s *mysqlStore) AddReaction(messageID, userID int64, emoji string) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO reaction (message_id, user_id, emoji) VALUES (?, ?, ?)",
+		messageID, userID, emoji)
+	return err
+}
+
+func (s *mysqlStore) RemoveReaction(messageID, userID int64, emoji string) error {
+	_, err := s.db.Exec("DELETE FROM reaction WHERE message_id = ? AND user_id = ? AND emoji = ?",
+		messageID, userID, emoji)
+	return err
+}
+
+func (s *mysqlStore) GetReactions(messageID int64) (MessageReactions, error) {
+	rows := make([]reactionRow, 0)
+	err := s.db.Select(&rows,
+		"SELECT message_id, user_id, emoji FROM reaction WHERE message_id = ? ORDER BY user_id", messageID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(MessageReactions)
+	for _, r := range rows {
+		res[r.Emoji] = append(res[r.Emoji], r.UserID)
+	}
+	return res, nil
+}
+
+func (s *mysqlStore) UpdateHaveRead(chanID, userID, messageID int64) error {
+	if err := s.checkChannel(chanID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		"INSERT INTO haveread (user_id, channel_id, message_id, updated_at, created_at) VALUES (?, ?, ?, NOW(), NOW())"+
+			" ON DUPLICATE KEY UPDATE message_id = VALUES(message_id), updated_at = NOW()",
+		userID, chanID, messageID)
+	return err
+}
+
+func (s *mysqlStore) GetHaveRead(chanID, userID int64) (int64, error) {
+	var id int64
+	err := s.db.Get(&id, "SELECT message_id FROM haveread WHERE user_id = ? AND channel_id = ?", userID, chanID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (s *mysqlStore) CountUnread(chanID, userID int64) (int64, error) {
+	lastID, err := s.GetHaveRead(chanID, userID)
+	if err != nil {
+		return 0, err
+	}
+	var cnt int64
+	err = s.db.Get(&cnt, "SELECT COUNT(*) FROM message WHERE channel_id = ? AND parent_id = 0 AND deleted_at IS NULL AND id > ?", chanID, lastID)
+	return cnt, err
+}
+
+func (s *mysqlStore) Dump() (*Dump, error) {
+	d := &Dump{
+		Users:     make(map[int64]*User),
+		Channels:  make(map[int64]*Channel),
+		Messages:  make(map[int64]*Message),
+		Reactions: make(map[int64]MessageReactions),
+	}
+	us := make([]*User, 0)
+	if err := s.db.Select(&us, "SELECT * FROM user"); err != nil {
+		return nil, err
+	}
+	for _, u := range us {
+		d.Users[u.ID] = u
+	}
+	chs, err := s.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chs {
+		d.Channels[ch.ID] = ch
+	}
+	ms := make([]*Message, 0)
+	if err := s.db.Select(&ms, "SELECT "+messageColumns+" FROM message"); err != nil {
+		return nil, err
+	}
+	for _, m := range ms {
+		d.Messages[m.ID] = m
+	}
+	mns := make([]mentionRow, 0)
+	if err := s.db.Select(&mns, "SELECT message_id, user_id FROM mention ORDER BY user_id"); err != nil {
+		return nil, err
+	}
+	for _, r := range mns {
+		if m := d.Messages[r.MessageID]; m != nil {
+			m.Mentions = append(m.Mentions, r.UserID)
+		}
+	}
+	rs := make([]reactionRow, 0)
+	if err := s.db.Select(&rs, "SELECT message_id, user_id, emoji FROM reaction ORDER BY user_id"); err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		if d.Reactions[r.MessageID] == nil {
+			d.Reactions[r.MessageID] = make(MessageReactions)
+		}
+		d.Reactions[r.MessageID][r.Emoji] = append(d.Reactions[r.MessageID][r.Emoji], r.UserID)
+	}
+	return d, nil
+}
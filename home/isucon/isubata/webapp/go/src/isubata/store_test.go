@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreEditUpdatesMentions(t *testing.T) {
+	s := newMemoryStore()
+	now := time.Now()
+	if err := s.PutChannel(&Channel{ID: 1, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{ID: 10, ChannelID: 1, UserID: 1, Content: "@bob @carol", CreatedAt: now, Mentions: []int64{2, 3}}
+	if err := s.AddMessage(m); err != nil {
+		t.Fatal(err)
+	}
+
+	later := now.Add(time.Second)
+	edit := *m
+	edit.Content = "@carol @dave"
+	edit.Mentions = []int64{3, 4}
+	edit.EditedAt = &later
+	if err := s.EditMessage(&edit); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		userID int64
+		want   int
+	}{{2, 0}, {3, 1}, {4, 1}} {
+		ms, err := s.GetMentions(tt.userID, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != tt.want {
+			t.Errorf("user %d has %d mentions, want %d", tt.userID, len(ms), tt.want)
+		}
+		if n, _ := s.CountUnreadMentions(1, tt.userID); n != int64(tt.want) {
+			t.Errorf("user %d has %d unread mentions, want %d", tt.userID, n, tt.want)
+		}
+		if len(ms) > 0 && ms[0].Content != edit.Content {
+			t.Errorf("user %d sees %q, want the edited content", tt.userID, ms[0].Content)
+		}
+	}
+
+	// an older edit arriving late changes nothing
+	stale := *m
+	stale.Content = "@bob"
+	stale.Mentions = []int64{2}
+	stale.EditedAt = &now
+	if err := s.EditMessage(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _ := s.GetMentions(2, 0, 10); len(ms) != 0 {
+		t.Errorf("stale edit brought back a mention of user 2")
+	}
+}
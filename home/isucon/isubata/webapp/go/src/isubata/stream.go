@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const streamHeartbeat = 15 * time.Second
+
+// getStream sends new messages of a channel as Server-Sent Events. The event
+// ID is the message ID, so a reconnecting client resumes from Last-Event-ID
+// the same way getMessage does from last_message_id.
+func getStream(c echo.Context) error {
+	sess := currentSession(c)
+	if sess == nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+	userID := sess.UserID
+
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	ch, err := store.GetChannel(chanID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrChannelNotFound
+	}
+
+	var lastID int64
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		lastID, err = strconv.ParseInt(v, 10, 64)
+	} else if v := c.QueryParam("last_message_id"); v != "" {
+		lastID, err = strconv.ParseInt(v, 10, 64)
+	}
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ctx := c.Request().Context()
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	checked := time.Now()
+	// like the WebSocket, start with at most catchUpLimit messages
+	limit := catchUpLimit
+	for {
+		wait := channelNotifier.Wait(chanID)
+		ms, err := store.GetMessagesAfter(chanID, lastID, limit, true)
+		limit = 0
+		if err != nil {
+			return err
+		}
+		for _, m := range ms {
+			r, err := jsonifyMessage(m)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: message\ndata: %s\n\n", m.ID, b); err != nil {
+				return nil
+			}
+			lastID = m.ID
+		}
+		if len(ms) > 0 {
+			res.Flush()
+			if err := store.UpdateHaveRead(chanID, userID, lastID); err != nil {
+				return err
+			}
+			replicateHaveRead(chanID, userID, lastID)
+		}
+
+		select {
+		case <-wait:
+		case now := <-ticker.C:
+			// end the stream of a session that was logged out or revoked
+			if now.Sub(checked) >= sessionRecheck {
+				if !sessionAlive(sess) {
+					return nil
+				}
+				checked = now
+			}
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -1,17 +1,109 @@
 package main
 
 import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
 	"strconv"
 
 	"github.com/labstack/echo"
 )
 
+const syncBatchMIME = "application/x-isubata-sync"
+
+const (
+	syncOpUser = iota + 1
+	syncOpChannel
+	syncOpMessage
+	syncOpHaveRead
+	syncOpEditMessage
+	syncOpDeleteMessage
+	syncOpAddReaction
+	syncOpRemoveReaction
+)
+
+// syncOp is one replicated mutation in a /sync/batch stream.
+type syncOp struct {
+	Kind      int
+	User      *User
+	Channel   *Channel
+	Message   *Message
+	ChannelID int64
+	UserID    int64
+	MessageID int64
+	Emoji     string
+}
+
+func applySyncOp(op *syncOp) error {
+	switch op.Kind {
+	case syncOpUser:
+		return store.PutUser(op.User)
+	case syncOpChannel:
+		return store.PutChannel(op.Channel)
+	case syncOpMessage:
+		return store.AddMessage(op.Message)
+	case syncOpHaveRead:
+		return store.UpdateHaveRead(op.ChannelID, op.UserID, op.MessageID)
+	case syncOpEditMessage:
+		return store.EditMessage(op.Message)
+	case syncOpDeleteMessage:
+		return store.DeleteMessage(op.Message)
+	case syncOpAddReaction:
+		return store.AddReaction(op.MessageID, op.UserID, op.Emoji)
+	case syncOpRemoveReaction:
+		return store.RemoveReaction(op.MessageID, op.UserID, op.Emoji)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown sync op %d", op.Kind))
+}
+
+// syncBatchResult says how far /sync/batch got. The first Done ops were
+// applied or rejected for good; the rest failed with Error and can be sent
+// again.
+type syncBatchResult struct {
+	Done     int           `json:"done"`
+	Rejected []syncOpError `json:"rejected,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type syncOpError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// syncBatch applies ops one by one. An op the store rejects, such as a
+// message for a channel this node doesn't have, is reported and skipped so
+// it doesn't hold up the ones after it.
+func syncBatch(c echo.Context) error {
+	dec := gob.NewDecoder(c.Request().Body)
+	res := &syncBatchResult{Rejected: []syncOpError{}}
+	for {
+		op := &syncOp{}
+		err := dec.Decode(op)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("op %d: %v", res.Done, err))
+		}
+		if err := applySyncOp(op); err != nil {
+			if !storeRejected(err) {
+				res.Error = fmt.Sprintf("op %d: %v", res.Done, err)
+				break
+			}
+			res.Rejected = append(res.Rejected, syncOpError{res.Done, err.Error()})
+		}
+		res.Done++
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
 func syncRegister(c echo.Context) (err error) {
 	u := User{}
 	if err = c.Bind(&u); err != nil {
 		return
 	}
-	users[u.ID] = &u
+	err = store.PutUser(&u)
 	return
 }
 
@@ -20,8 +112,7 @@ func syncMessage(c echo.Context) (err error) {
 	if err = c.Bind(&m); err != nil {
 		return
 	}
-	messages.Store(m.ID, &m)
-	channels.Load(m.ChannelID).AddMessage(&m)
+	err = store.AddMessage(&m)
 	return
 }
 
@@ -30,7 +121,7 @@ func syncProfile(c echo.Context) (err error) {
 	if err = c.Bind(&u); err != nil {
 		return
 	}
-	users[u.ID] = &u
+	err = store.PutUser(&u)
 	return
 }
 
@@ -39,9 +130,7 @@ func syncAddChannel(c echo.Context) (err error) {
 	if err = c.Bind(&ch); err != nil {
 		return
 	}
-	ch.HaveRead = HaveRead{}
-	ch.Messages = make([]*Message, 0)
-	channels.Store(ch.ID, &ch)
+	err = store.PutChannel(&ch)
 	return
 }
 
@@ -58,6 +147,5 @@ func syncHaveRead(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	channels.Load(chanID).UpdateHaveRead(userID, messageID)
-	return nil
+	return store.UpdateHaveRead(chanID, userID, messageID)
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	syncTimestampHeader = "X-Isubata-Timestamp"
+	syncNonceHeader     = "X-Isubata-Nonce"
+	syncSignatureHeader = "X-Isubata-Signature"
+
+	syncReplayWindow = 30 * time.Second
+	// a /sync/* body is read whole before its signature is checked
+	syncMaxBody = 32 << 20
+)
+
+var (
+	syncSecret []byte
+
+	syncNonces      = make(map[string]time.Time)
+	syncNoncePurged time.Time
+	syncRejected    = make(map[string]int64)
+	syncAuthM       sync.Mutex
+)
+
+// initSyncAuth loads the shared secret. Running without one has to be asked
+// for with ISUBATA_SYNC_INSECURE=1, since then anyone can write through
+// /sync/*.
+func initSyncAuth() {
+	syncSecret = []byte(os.Getenv("ISUBATA_SYNC_SECRET"))
+	if len(syncSecret) > 0 {
+		return
+	}
+	if os.Getenv("ISUBATA_SYNC_INSECURE") != "1" {
+		log.Fatal("sync: ISUBATA_SYNC_SECRET is not set; put it in /home/isucon/secret.env, or set ISUBATA_SYNC_INSECURE=1 to run /sync/* unauthenticated")
+	}
+	log.Println("sync: ISUBATA_SYNC_SECRET is not set, /sync/* is unauthenticated")
+}
+
+func syncSignature(method, uri, ts, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, syncSecret)
+	io.WriteString(mac, method+"\n"+uri+"\n"+ts+"\n"+nonce+"\n")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSyncRequest builds a signed request to another app server.
+func newSyncRequest(method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(syncSecret) == 0 {
+		return req, nil
+	}
+	nb := make([]byte, 16)
+	if _, err := crand.Read(nb); err != nil {
+		return nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(nb)
+	req.Header.Set(syncTimestampHeader, ts)
+	req.Header.Set(syncNonceHeader, nonce)
+	req.Header.Set(syncSignatureHeader, syncSignature(method, req.URL.RequestURI(), ts, nonce, body))
+	return req, nil
+}
+
+func rejectSync(c echo.Context, reason string) error {
+	syncAuthM.Lock()
+	syncRejected[reason]++
+	syncAuthM.Unlock()
+	log.Printf("sync: rejected %s %s from %s: %s",
+		c.Request().Method, c.Request().URL.RequestURI(), c.RealIP(), reason)
+	return echo.ErrUnauthorized
+}
+
+// seenNonce records nonce and reports whether it was already used inside the
+// replay window.
+func seenNonce(nonce string, now time.Time) bool {
+	syncAuthM.Lock()
+	defer syncAuthM.Unlock()
+	if now.Sub(syncNoncePurged) > time.Second {
+		for n, t := range syncNonces {
+			if now.Sub(t) > syncReplayWindow {
+				delete(syncNonces, n)
+			}
+		}
+		syncNoncePurged = now
+	}
+	if _, ok := syncNonces[nonce]; ok {
+		return true
+	}
+	syncNonces[nonce] = now
+	return false
+}
+
+// verifySyncRequest checks the signature of req, leaving its body readable
+// again. It returns why req is rejected, or "" if it isn't.
+func verifySyncRequest(w http.ResponseWriter, req *http.Request, now time.Time) (string, error) {
+	ts := req.Header.Get(syncTimestampHeader)
+	nonce := req.Header.Get(syncNonceHeader)
+	sig := req.Header.Get(syncSignatureHeader)
+	if ts == "" || nonce == "" || sig == "" {
+		return "missing signature", nil
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "bad timestamp", nil
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > syncReplayWindow || d < -syncReplayWindow {
+		return "stale timestamp", nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, syncMaxBody))
+	req.Body.Close()
+	if err != nil {
+		if len(body) >= syncMaxBody {
+			return "body too large", nil
+		}
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	want := syncSignature(req.Method, req.URL.RequestURI(), ts, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "bad signature", nil
+	}
+	if seenNonce(nonce, now) {
+		return "replayed", nil
+	}
+	return "", nil
+}
+
+func syncAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(syncSecret) == 0 {
+			return next(c)
+		}
+		reason, err := verifySyncRequest(c.Response(), c.Request(), time.Now())
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return rejectSync(c, reason)
+		}
+		return next(c)
+	}
+}
+
+func getSyncAuthStatus(c echo.Context) error {
+	syncAuthM.Lock()
+	res := make(map[string]int64, len(syncRejected))
+	for k, v := range syncRejected {
+		res[k] = v
+	}
+	syncAuthM.Unlock()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":  len(syncSecret) > 0,
+		"rejected": res,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifySyncRequest(t *testing.T) {
+	syncSecret = []byte("test secret")
+	defer func() { syncSecret = nil }()
+
+	body := []byte("payload")
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		now    time.Duration
+		want   string
+	}{
+		{"valid", nil, 0, ""},
+		{"tampered body", func(req *http.Request) {
+			req.Body = ioutil.NopCloser(bytes.NewReader([]byte("payloaD")))
+		}, 0, "bad signature"},
+		{"tampered path", func(req *http.Request) {
+			req.URL.Path = "/sync/initialize"
+		}, 0, "bad signature"},
+		{"tampered method", func(req *http.Request) {
+			req.Method = http.MethodPut
+		}, 0, "bad signature"},
+		{"missing signature", func(req *http.Request) {
+			req.Header.Del(syncSignatureHeader)
+		}, 0, "missing signature"},
+		{"bad timestamp", func(req *http.Request) {
+			req.Header.Set(syncTimestampHeader, "yesterday")
+		}, 0, "bad timestamp"},
+		{"old", nil, syncReplayWindow + time.Second, "stale timestamp"},
+		{"from the future", nil, -syncReplayWindow - time.Second, "stale timestamp"},
+		{"too large", func(req *http.Request) {
+			req.Body = ioutil.NopCloser(bytes.NewReader(make([]byte, syncMaxBody+1)))
+		}, 0, "body too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newSyncRequest(http.MethodPost, "http://app2/sync/batch?x=1", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.modify != nil {
+				tt.modify(req)
+			}
+			reason, err := verifySyncRequest(httptest.NewRecorder(), req, time.Now().Add(tt.now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason != tt.want {
+				t.Fatalf("reason = %q, want %q", reason, tt.want)
+			}
+			if reason == "" {
+				got, _ := ioutil.ReadAll(req.Body)
+				if !bytes.Equal(got, body) {
+					t.Fatalf("body after verifying = %q, want %q", got, body)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySyncRequestReplay(t *testing.T) {
+	syncSecret = []byte("test secret")
+	defer func() { syncSecret = nil }()
+
+	req, err := newSyncRequest(http.MethodPost, "http://app2/sync/batch", []byte("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if reason, err := verifySyncRequest(httptest.NewRecorder(), req, now); err != nil || reason != "" {
+		t.Fatalf("first = %q, %v; want accepted", reason, err)
+	}
+	if reason, err := verifySyncRequest(httptest.NewRecorder(), req, now); err != nil || reason != "replayed" {
+		t.Fatalf("second = %q, %v; want replayed", reason, err)
+	}
+
+	syncSecret = []byte("other secret")
+	req, err = newSyncRequest(http.MethodPost, "http://app2/sync/batch", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncSecret = []byte("test secret")
+	if reason, _ := verifySyncRequest(httptest.NewRecorder(), req, now); reason != "bad signature" {
+		t.Fatalf("other secret = %q, want bad signature", reason)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// getThread serves GET /message/:id/thread: the parent message and its
+// replies, oldest first. The parent is null if it has been deleted.
+func getThread(c echo.Context) error {
+	if sessUserID(c) == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return ErrBadReqeust
+	}
+	p, err := store.GetMessage(id)
+	if err != nil {
+		return err
+	}
+	if p == nil || p.ParentID != 0 {
+		return ErrMessageNotFound
+	}
+
+	var parent interface{}
+	if !p.Deleted() {
+		if parent, err = jsonifyMessage(p); err != nil {
+			return err
+		}
+	}
+	ms, err := store.GetThread(p.ChannelID, p.ID)
+	if err != nil {
+		return err
+	}
+	replies := make([]map[string]interface{}, 0, len(ms))
+	for _, m := range ms {
+		r, err := jsonifyMessage(m)
+		if err != nil {
+			return err
+		}
+		replies = append(replies, r)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"parent":  parent,
+		"replies": replies,
+	})
+}
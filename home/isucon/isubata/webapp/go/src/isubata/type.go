@@ -16,6 +16,9 @@ type User struct {
 	DisplayName string    `json:"display_name" db:"display_name"`
 	AvatarIcon  string    `json:"avatar_icon" db:"avatar_icon"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	// UpdatedAt is when the profile, name or password last changed. Of two
+	// copies of a user the later one wins.
+	UpdatedAt time.Time `json:"updated_at" db:"-"`
 }
 
 type HaveRead struct {
@@ -43,8 +46,15 @@ func (hr *HaveRead) GobEncode() ([]byte, error) {
 }
 
 func (hr *HaveRead) GobDecode(b []byte) error {
+	h := make(map[int64]int64)
 	d := gob.NewDecoder(bytes.NewBuffer(b))
-	return d.Decode(hr)
+	if err := d.Decode(&h); err != nil {
+		return err
+	}
+	for k, v := range h {
+		hr.Store(k, v)
+	}
+	return nil
 }
 
 type Channel struct {
@@ -54,22 +64,90 @@ type Channel struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 	CreatedAt   time.Time `json:"created_at"`
 
-	HaveRead HaveRead   `json:"-"`
-	Messages []*Message `json:"-"`
+	HaveRead HaveRead `json:"-"`
 
-	m sync.RWMutex
+	// messages holds every message of the channel, timeline only the ones
+	// that are not thread replies and threads the replies by parent ID.
+	messages messageIndex
+	timeline messageIndex
+	threads  map[int64]*messageIndex
+	m        sync.RWMutex
 }
 
 func (c *Channel) AddMessage(m *Message) {
 	c.m.Lock()
-	c.Messages = append(c.Messages, m)
-	sort.Slice(c.Messages, func(i, j int) bool {
-		return c.Messages[i].ID < c.Messages[j].ID
-		return c.Messages[i].CreatedAt.Before(c.Messages[j].CreatedAt)
-	})
+	c.insert(m)
 	c.m.Unlock()
 }
 
+func (c *Channel) thread(parentID int64, create bool) *messageIndex {
+	t := c.threads[parentID]
+	if t == nil && create {
+		if c.threads == nil {
+			c.threads = make(map[int64]*messageIndex)
+		}
+		t = &messageIndex{}
+		c.threads[parentID] = t
+	}
+	return t
+}
+
+// insert, replace and remove keep the indexes in step. The caller holds c.m.
+func (c *Channel) insert(m *Message) {
+	if !c.messages.Insert(m) {
+		return
+	}
+	if m.ParentID == 0 {
+		c.timeline.Insert(m)
+	} else {
+		c.thread(m.ParentID, true).Insert(m)
+	}
+}
+
+func (c *Channel) replace(m *Message) {
+	if !c.messages.Replace(m) {
+		return
+	}
+	if m.ParentID == 0 {
+		c.timeline.Replace(m)
+	} else {
+		c.thread(m.ParentID, true).Replace(m)
+	}
+}
+
+func (c *Channel) remove(m *Message) bool {
+	if !c.messages.Remove(m.ID) {
+		return false
+	}
+	if m.ParentID == 0 {
+		c.timeline.Remove(m.ID)
+	} else if t := c.thread(m.ParentID, false); t != nil {
+		t.Remove(m.ID)
+	}
+	return true
+}
+
+// Len returns the number of messages in the timeline.
+func (c *Channel) Len() int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.timeline.Len()
+}
+
+func (c *Channel) Clone() *Channel {
+	res := &Channel{
+		ID:          c.ID,
+		Name:        c.Name,
+		Description: c.Description,
+		UpdatedAt:   c.UpdatedAt,
+		CreatedAt:   c.CreatedAt,
+	}
+	for k, v := range c.HaveRead.Hash() {
+		res.HaveRead.Store(k, v)
+	}
+	return res
+}
+
 func (c *Channel) UpdateHaveRead(userID, messageID int64) {
 	c.HaveRead.Store(userID, messageID)
 }
@@ -82,28 +160,111 @@ func (c *Channel) GetHaveRead(userID int64) int64 {
 	return v.(int64)
 }
 
-func (c *Channel) GetMessagesAfter(id int64) []*Message {
-	res := make([]*Message, 0)
+// CountAfter returns how many timeline messages have an ID greater than id.
+func (c *Channel) CountAfter(id int64) int64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return int64(c.timeline.Len() - c.timeline.After(id))
+}
+
+// GetMessagesAfter returns the timeline messages with an ID greater than id,
+// oldest first, and thread replies as well if replies is set. If limit is
+// positive only the newest limit of them are returned.
+func (c *Channel) GetMessagesAfter(id int64, limit int, replies bool) []*Message {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	x := &c.timeline
+	if replies {
+		x = &c.messages
+	}
+	from, to := x.After(id), x.Len()
+	if limit > 0 && to-from > limit {
+		from = to - limit
+	}
+	return x.Slice(from, to)
+}
+
+// Thread returns the replies to parentID, oldest first.
+func (c *Channel) Thread(parentID int64) []*Message {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	t := c.thread(parentID, false)
+	if t == nil {
+		return []*Message{}
+	}
+	return t.Slice(0, t.Len())
+}
+
+func (c *Channel) CountReplies(parentID int64) int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if t := c.thread(parentID, false); t != nil {
+		return t.Len()
+	}
+	return 0
+}
+
+// Latest skips the newest offset timeline messages and returns up to limit of the
+// ones before them, oldest first.
+func (c *Channel) Latest(offset, limit int) []*Message {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	to := c.timeline.Len() - offset
+	return c.timeline.Slice(to-limit, to)
+}
+
+// Page returns up to limit timeline messages with after < ID < before, oldest first,
+// and whether there are older and newer messages outside of it. A zero before
+// means no upper bound. The page is taken from the newest end of the range
+// unless only after is given, so a client can walk in either direction.
+func (c *Channel) Page(after, before int64, limit int) *MessagePage {
 	c.m.RLock()
-	for _, m := range c.Messages {
-		if m.ID > id {
-			res = append(res, m)
+	defer c.m.RUnlock()
+	lo, hi := c.timeline.After(after), c.timeline.Len()
+	if before > 0 {
+		hi = c.timeline.After(before - 1)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	from, to := lo, hi
+	if before > 0 || after == 0 {
+		if to-from > limit {
+			from = to - limit
 		}
+	} else if to-from > limit {
+		to = from + limit
+	}
+	return &MessagePage{
+		Messages: c.timeline.Slice(from, to),
+		HasOlder: from > 0,
+		HasNewer: to < c.timeline.Len(),
 	}
-	c.m.RUnlock()
-	return res
 }
 
 type Message struct {
-	ID        int64     `db:"id"`
-	ChannelID int64     `db:"channel_id"`
-	UserID    int64     `db:"user_id"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        int64      `db:"id"`
+	ChannelID int64      `db:"channel_id"`
+	UserID    int64      `db:"user_id"`
+	Content   string     `db:"content"`
+	CreatedAt time.Time  `db:"created_at"`
+	ParentID  int64      `db:"parent_id"`
+	EditedAt  *time.Time `db:"edited_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+
+	// Mentions are the IDs of the users named with @name in Content,
+	// resolved when the message was posted or last edited.
+	Mentions []int64 `db:"-"`
 
 	User *User
 }
 
+// Deleted reports whether m is a tombstone. Tombstones keep the ID, channel
+// and author of a deleted message so a late copy of it is not added back.
+func (m *Message) Deleted() bool {
+	return m.DeletedAt != nil
+}
+
 type Channels struct {
 	sync.Map
 }
@@ -125,6 +286,15 @@ func (c *Channels) Range(f func(int64, *Channel) bool) {
 	})
 }
 
+// Clear removes every channel. It is safe alongside readers, unlike
+// assigning a new Channels.
+func (c *Channels) Clear() {
+	c.Map.Range(func(k, _ interface{}) bool {
+		c.Map.Delete(k)
+		return true
+	})
+}
+
 func (c *Channels) Slice() []*Channel {
 	res := make([]*Channel, 0)
 	c.Range(func(_ int64, ch *Channel) bool {
@@ -147,6 +317,15 @@ type Messages struct {
 	sync.Map
 }
 
+func (m *Messages) Load(id int64) *Message {
+	v, ok := m.Map.Load(id)
+	if !ok {
+		return nil
+	}
+	res, _ := v.(*Message)
+	return res
+}
+
 func (m *Messages) Range(f func(int64, *Message) bool) {
 	m.Map.Range(func(k, v interface{}) bool {
 		id, _ := k.(int64)
@@ -155,6 +334,15 @@ func (m *Messages) Range(f func(int64, *Message) bool) {
 	})
 }
 
+// Clear removes every message. It is safe alongside readers, unlike
+// assigning a new Messages.
+func (m *Messages) Clear() {
+	m.Map.Range(func(k, _ interface{}) bool {
+		m.Map.Delete(k)
+		return true
+	})
+}
+
 func (m *Messages) Hash() map[int64]*Message {
 	res := make(map[int64]*Message, 0)
 	m.Range(func(id int64, v *Message) bool {
@@ -164,8 +352,268 @@ func (m *Messages) Hash() map[int64]*Message {
 	return res
 }
 
+type mentionKey struct {
+	userID, chanID int64
+}
+
+// Mentions indexes the messages that mention each user, across all channels
+// and per channel.
+type Mentions struct {
+	byUser    map[int64]*messageIndex
+	byChannel map[mentionKey]*messageIndex
+	m         sync.RWMutex
+}
+
+func (x *Mentions) Reset() {
+	x.m.Lock()
+	x.byUser = nil
+	x.byChannel = nil
+	x.m.Unlock()
+}
+
+func (x *Mentions) Add(m *Message) {
+	if len(m.Mentions) == 0 {
+		return
+	}
+	x.m.Lock()
+	defer x.m.Unlock()
+	if x.byUser == nil {
+		x.byUser = make(map[int64]*messageIndex)
+		x.byChannel = make(map[mentionKey]*messageIndex)
+	}
+	for _, userID := range m.Mentions {
+		u := x.byUser[userID]
+		if u == nil {
+			u = &messageIndex{}
+			x.byUser[userID] = u
+		}
+		u.Insert(m)
+		k := mentionKey{userID, m.ChannelID}
+		c := x.byChannel[k]
+		if c == nil {
+			c = &messageIndex{}
+			x.byChannel[k] = c
+		}
+		c.Insert(m)
+	}
+}
+
+func (x *Mentions) Remove(m *Message) {
+	x.m.Lock()
+	defer x.m.Unlock()
+	for _, userID := range m.Mentions {
+		if u := x.byUser[userID]; u != nil {
+			u.Remove(m.ID)
+		}
+		if c := x.byChannel[mentionKey{userID, m.ChannelID}]; c != nil {
+			c.Remove(m.ID)
+		}
+	}
+}
+
+// Update swaps old for m, an edit of it, adding and removing only the users
+// whose mention changed.
+func (x *Mentions) Update(old, m *Message) {
+	x.m.Lock()
+	defer x.m.Unlock()
+	keep := make(map[int64]bool, len(m.Mentions))
+	for _, userID := range m.Mentions {
+		keep[userID] = true
+	}
+	for _, userID := range old.Mentions {
+		if keep[userID] {
+			continue
+		}
+		if u := x.byUser[userID]; u != nil {
+			u.Remove(old.ID)
+		}
+		if c := x.byChannel[mentionKey{userID, old.ChannelID}]; c != nil {
+			c.Remove(old.ID)
+		}
+	}
+	if len(m.Mentions) > 0 && x.byUser == nil {
+		x.byUser = make(map[int64]*messageIndex)
+		x.byChannel = make(map[mentionKey]*messageIndex)
+	}
+	for _, userID := range m.Mentions {
+		u := x.byUser[userID]
+		if u == nil {
+			u = &messageIndex{}
+			x.byUser[userID] = u
+		}
+		if !u.Replace(m) {
+			u.Insert(m)
+		}
+		k := mentionKey{userID, m.ChannelID}
+		c := x.byChannel[k]
+		if c == nil {
+			c = &messageIndex{}
+			x.byChannel[k] = c
+		}
+		if !c.Replace(m) {
+			c.Insert(m)
+		}
+	}
+}
+
+// Before returns the IDs of up to limit messages mentioning userID with an ID
+// below before, newest first. A zero before means no upper bound.
+func (x *Mentions) Before(userID, before int64, limit int) []int64 {
+	x.m.RLock()
+	defer x.m.RUnlock()
+	u := x.byUser[userID]
+	if u == nil {
+		return []int64{}
+	}
+	to := u.Len()
+	if before > 0 {
+		to = u.After(before - 1)
+	}
+	ms := u.Slice(to-limit, to)
+	res := make([]int64, 0, len(ms))
+	for i := len(ms) - 1; i >= 0; i-- {
+		res = append(res, ms[i].ID)
+	}
+	return res
+}
+
+// CountAfter returns how many messages in chanID mentioning userID have an ID
+// greater than id.
+func (x *Mentions) CountAfter(userID, chanID, id int64) int {
+	x.m.RLock()
+	defer x.m.RUnlock()
+	c := x.byChannel[mentionKey{userID, chanID}]
+	if c == nil {
+		return 0
+	}
+	return c.Len() - c.After(id)
+}
+
+// MessageReactions maps an emoji to the IDs of the users who reacted with it.
+type MessageReactions map[string][]int64
+
+// Reactions holds the reactions of every message, keyed by message ID, and
+// when those of each message last changed here, so that anti-entropy can tell
+// which of two copies is newer.
+type Reactions struct {
+	h  map[int64]map[string]map[int64]struct{}
+	at map[int64]time.Time
+	m  sync.RWMutex
+}
+
+func (r *Reactions) Reset() {
+	r.m.Lock()
+	r.h = nil
+	r.at = nil
+	r.m.Unlock()
+}
+
+func (r *Reactions) touch(messageID int64) {
+	if r.at == nil {
+		r.at = make(map[int64]time.Time)
+	}
+	r.at[messageID] = time.Now()
+}
+
+// ForgetVersions makes every message's reactions older than any change made
+// after it. Reactions replayed at boot would otherwise look newer than what
+// the other nodes did meanwhile.
+func (r *Reactions) ForgetVersions() {
+	r.m.Lock()
+	r.at = nil
+	r.m.Unlock()
+}
+
+// Version returns the reactions of messageID and when they last changed.
+func (r *Reactions) Version(messageID int64) (MessageReactions, time.Time) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.get(messageID), r.at[messageID]
+}
+
+// Add records that userID reacted to messageID with emoji and reports
+// whether that is new.
+func (r *Reactions) Add(messageID, userID int64, emoji string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.h == nil {
+		r.h = make(map[int64]map[string]map[int64]struct{})
+	}
+	es := r.h[messageID]
+	if es == nil {
+		es = make(map[string]map[int64]struct{})
+		r.h[messageID] = es
+	}
+	us := es[emoji]
+	if us == nil {
+		us = make(map[int64]struct{})
+		es[emoji] = us
+	}
+	if _, ok := us[userID]; ok {
+		return false
+	}
+	us[userID] = struct{}{}
+	r.touch(messageID)
+	return true
+}
+
+func (r *Reactions) Remove(messageID, userID int64, emoji string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	us := r.h[messageID][emoji]
+	if _, ok := us[userID]; !ok {
+		return false
+	}
+	delete(us, userID)
+	if len(us) == 0 {
+		delete(r.h[messageID], emoji)
+	}
+	if len(r.h[messageID]) == 0 {
+		delete(r.h, messageID)
+	}
+	r.touch(messageID)
+	return true
+}
+
+func (r *Reactions) Get(messageID int64) MessageReactions {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.get(messageID)
+}
+
+func (r *Reactions) get(messageID int64) MessageReactions {
+	res := make(MessageReactions)
+	for e, us := range r.h[messageID] {
+		ids := make([]int64, 0, len(us))
+		for id := range us {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		res[e] = ids
+	}
+	return res
+}
+
+func (r *Reactions) Hash() map[int64]MessageReactions {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	res := make(map[int64]MessageReactions, len(r.h))
+	for id := range r.h {
+		res[id] = r.get(id)
+	}
+	return res
+}
+
 type Dump struct {
-	Users    map[int64]*User    `json:"users"`
-	Channels map[int64]*Channel `json:"channels"`
-	Messages map[int64]*Message `json:"messages"`
+	Users     map[int64]*User            `json:"users"`
+	Channels  map[int64]*Channel         `json:"channels"`
+	Messages  map[int64]*Message         `json:"messages"`
+	Reactions map[int64]MessageReactions `json:"reactions"`
+}
+
+// MessagePage is one page of a channel's history, oldest first.
+type MessagePage struct {
+	Messages []*Message
+	HasOlder bool
+	HasNewer bool
 }
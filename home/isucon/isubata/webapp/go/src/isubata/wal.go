@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	walPutUser        = "user"
+	walAddUser        = "adduser"
+	walPutChannel     = "channel"
+	walAddMessage     = "message"
+	walUpdateHaveRead = "haveread"
+	walEditMessage    = "edit"
+	walDeleteMessage  = "delete"
+	walAddReaction    = "react"
+	walRemoveReaction = "unreact"
+
+	walCheckpointFile = "checkpoint.gob"
+)
+
+type walEntry struct {
+	Op        string   `json:"op"`
+	User      *User    `json:"user,omitempty"`
+	Channel   *Channel `json:"channel,omitempty"`
+	Message   *Message `json:"message,omitempty"`
+	ChannelID int64    `json:"channel_id,omitempty"`
+	UserID    int64    `json:"user_id,omitempty"`
+	MessageID int64    `json:"message_id,omitempty"`
+	Emoji     string   `json:"emoji,omitempty"`
+}
+
+type walRequest struct {
+	e    *walEntry
+	done chan error
+}
+
+type walCheckpoint struct {
+	Seq  int
+	Dump *Dump
+}
+
+// journal is an append-only log of store mutations. Append waits for fsync,
+// but everything queued while a sync is running is written with the next one.
+type journal struct {
+	dir  string
+	seq  int
+	f    *os.File
+	w    *bufio.Writer
+	reqs chan *walRequest
+
+	// held shared while appending and applying, exclusively while rotating
+	m sync.RWMutex
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segs, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{
+		dir:  dir,
+		reqs: make(chan *walRequest, 1024),
+	}
+	if len(segs) > 0 {
+		j.seq = segs[len(segs)-1]
+	}
+	if err := j.openSegment(j.seq + 1); err != nil {
+		return nil, err
+	}
+	go j.run()
+	return j, nil
+}
+
+func walSegments(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "wal.*.log"))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, 0, len(names))
+	for _, name := range names {
+		base := filepath.Base(name)
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(base, "wal."), ".log"))
+		if err != nil {
+			continue
+		}
+		res = append(res, seq)
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+func (j *journal) segmentPath(seq int) string {
+	return filepath.Join(j.dir, fmt.Sprintf("wal.%08d.log", seq))
+}
+
+func (j *journal) openSegment(seq int) error {
+	f, err := os.OpenFile(j.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.seq = seq
+	j.f = f
+	j.w = bufio.NewWriterSize(f, 64*1024)
+	return nil
+}
+
+func (j *journal) run() {
+	for req := range j.reqs {
+		batch := []*walRequest{req}
+	drain:
+		for {
+			select {
+			case r := <-j.reqs:
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+
+		var err error
+		enc := json.NewEncoder(j.w)
+		for _, r := range batch {
+			if err = enc.Encode(r.e); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = j.w.Flush()
+		}
+		if err == nil {
+			err = j.f.Sync()
+		}
+		for _, r := range batch {
+			r.done <- err
+		}
+	}
+}
+
+func (j *journal) Append(e *walEntry) error {
+	req := &walRequest{e: e, done: make(chan error, 1)}
+	j.reqs <- req
+	return <-req.done
+}
+
+// Do calls apply and, if the store took the change, writes e to the log.
+// Logging only what was applied keeps requests the store turns down, such as
+// a message for an unknown channel, out of the log.
+func (j *journal) Do(e *walEntry, apply func() error) error {
+	j.m.RLock()
+	defer j.m.RUnlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	if err := j.Append(e); err != nil {
+		log.Printf("wal: %s applied but not logged: %v", e.Op, err)
+		return err
+	}
+	return nil
+}
+
+func (j *journal) Replay(s Store) (int, error) {
+	from := 0
+	cp, err := j.loadCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+	if cp != nil {
+		if err := applyDump(s, cp.Dump); err != nil {
+			return 0, err
+		}
+		from = cp.Seq
+	}
+
+	segs, err := walSegments(j.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seq := range segs {
+		if seq < from || seq >= j.seq {
+			continue
+		}
+		c, err := j.replaySegment(s, seq)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (j *journal) replaySegment(s Store, seq int) (int, error) {
+	f, err := os.Open(j.segmentPath(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e walEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			// a torn tail was never acknowledged, so drop it
+			log.Printf("wal: stop replaying %s: %v", j.segmentPath(seq), err)
+			return n, nil
+		}
+		if err := applyWALEntry(s, &e); err != nil {
+			// logs written before entries were checked can hold ones the
+			// store turned down at the time, and will again
+			if !storeRejected(err) {
+				return n, err
+			}
+			log.Printf("wal: skipping %s entry in %s: %v", e.Op, j.segmentPath(seq), err)
+			continue
+		}
+		n++
+	}
+}
+
+func applyWALEntry(s Store, e *walEntry) error {
+	switch e.Op {
+	case walPutUser:
+		return s.PutUser(e.User)
+	case walAddUser:
+		return s.AddUser(e.User)
+	case walPutChannel:
+		return s.PutChannel(e.Channel)
+	case walAddMessage:
+		return s.AddMessage(e.Message)
+	case walUpdateHaveRead:
+		return s.UpdateHaveRead(e.ChannelID, e.UserID, e.MessageID)
+	case walEditMessage:
+		return s.EditMessage(e.Message)
+	case walDeleteMessage:
+		return s.DeleteMessage(e.Message)
+	case walAddReaction:
+		return s.AddReaction(e.MessageID, e.UserID, e.Emoji)
+	case walRemoveReaction:
+		return s.RemoveReaction(e.MessageID, e.UserID, e.Emoji)
+	}
+	return fmt.Errorf("wal: unknown op %q", e.Op)
+}
+
+// storeRejected reports whether err is a store turning down a change, as
+// opposed to failing to make it.
+func storeRejected(err error) bool {
+	he, ok := err.(*echo.HTTPError)
+	return ok && he.Code < http.StatusInternalServerError
+}
+
+func applyDump(s Store, d *Dump) error {
+	for _, u := range d.Users {
+		if err := s.PutUser(u); err != nil {
+			return err
+		}
+	}
+	for _, ch := range d.Channels {
+		if err := s.PutChannel(&Channel{
+			ID:          ch.ID,
+			Name:        ch.Name,
+			Description: ch.Description,
+			UpdatedAt:   ch.UpdatedAt,
+			CreatedAt:   ch.CreatedAt,
+		}); err != nil {
+			return err
+		}
+	}
+	ms := make([]*Message, 0, len(d.Messages))
+	for _, m := range d.Messages {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].ID < ms[j].ID
+	})
+	for _, m := range ms {
+		if err := s.AddMessage(m); err != nil {
+			return err
+		}
+	}
+	for messageID, rs := range d.Reactions {
+		for emoji, userIDs := range rs {
+			for _, userID := range userIDs {
+				if err := s.AddReaction(messageID, userID, emoji); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, ch := range d.Channels {
+		for userID, messageID := range ch.HaveRead.Hash() {
+			if err := s.UpdateHaveRead(ch.ID, userID, messageID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (j *journal) loadCheckpoint() (*walCheckpoint, error) {
+	f, err := os.Open(filepath.Join(j.dir, walCheckpointFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cp := &walCheckpoint{}
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Compact rotates to a new segment, writes the state at that point as the
+// checkpoint and removes the segments it covers.
+func (j *journal) Compact(s Store) error {
+	j.m.Lock()
+	if err := j.openSegment(j.seq + 1); err != nil {
+		j.m.Unlock()
+		return err
+	}
+	seq := j.seq
+	d, err := s.Dump()
+	j.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, walCheckpointFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(&walCheckpoint{Seq: seq, Dump: d}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	segs, err := walSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, old := range segs {
+		if old < seq {
+			os.Remove(j.segmentPath(old))
+		}
+	}
+	return nil
+}
+
+func (j *journal) compactLoop(s Store, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := j.Compact(s); err != nil {
+			log.Println("wal: failed to compact:", err)
+			continue
+		}
+		log.Println("wal: compacted")
+	}
+}
+
+type walStore struct {
+	Store
+	j *journal
+}
+
+func (s *walStore) Reset() error {
+	if err := s.Store.Reset(); err != nil {
+		return err
+	}
+	return s.j.Compact(s.Store)
+}
+
+func (s *walStore) PutUser(u *User) error {
+	return s.j.Do(&walEntry{Op: walPutUser, User: u}, func() error {
+		return s.Store.PutUser(u)
+	})
+}
+
+func (s *walStore) AddUser(u *User) error {
+	return s.j.Do(&walEntry{Op: walAddUser, User: u}, func() error {
+		return s.Store.AddUser(u)
+	})
+}
+
+func (s *walStore) PutChannel(ch *Channel) error {
+	return s.j.Do(&walEntry{Op: walPutChannel, Channel: ch}, func() error {
+		return s.Store.PutChannel(ch)
+	})
+}
+
+func (s *walStore) AddMessage(m *Message) error {
+	logged := *m
+	logged.User = nil
+	return s.j.Do(&walEntry{Op: walAddMessage, Message: &logged}, func() error {
+		return s.Store.AddMessage(m)
+	})
+}
+
+func (s *walStore) EditMessage(m *Message) error {
+	logged := *m
+	logged.User = nil
+	return s.j.Do(&walEntry{Op: walEditMessage, Message: &logged}, func() error {
+		return s.Store.EditMessage(m)
+	})
+}
+
+func (s *walStore) DeleteMessage(m *Message) error {
+	logged := *m
+	logged.User = nil
+	return s.j.Do(&walEntry{Op: walDeleteMessage, Message: &logged}, func() error {
+		return s.Store.DeleteMessage(m)
+	})
+}
+
+func (s *walStore) AddReaction(messageID, userID int64, emoji string) error {
+	e := &walEntry{Op: walAddReaction, MessageID: messageID, UserID: userID, Emoji: emoji}
+	return s.j.Do(e, func() error {
+		return s.Store.AddReaction(messageID, userID, emoji)
+	})
+}
+
+func (s *walStore) RemoveReaction(messageID, userID int64, emoji string) error {
+	e := &walEntry{Op: walRemoveReaction, MessageID: messageID, UserID: userID, Emoji: emoji}
+	return s.j.Do(e, func() error {
+		return s.Store.RemoveReaction(messageID, userID, emoji)
+	})
+}
+
+func (s *walStore) UpdateHaveRead(chanID, userID, messageID int64) error {
+	e := &walEntry{Op: walUpdateHaveRead, ChannelID: chanID, UserID: userID, MessageID: messageID}
+	return s.j.Do(e, func() error {
+		return s.Store.UpdateHaveRead(chanID, userID, messageID)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWALReplaySkipsRejectedEntries(t *testing.T) {
+	dir := t.TempDir()
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &walStore{Store: newMemoryStore(), j: j}
+	now := time.Now()
+
+	if err := ws.PutUser(&User{ID: 1, Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.PutChannel(&Channel{ID: 1, Name: "general", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.AddMessage(&Message{ID: 10, ChannelID: 1, UserID: 1, Content: "hi", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	// turned down by the store, so it must not be logged
+	if err := ws.AddMessage(&Message{ID: 11, ChannelID: 99, UserID: 1, Content: "lost", CreatedAt: now}); err != ErrChannelNotFound {
+		t.Fatalf("AddMessage to unknown channel = %v, want ErrChannelNotFound", err)
+	}
+	if err := ws.AddUser(&User{ID: 2, Name: "alice"}); err != ErrNameTaken {
+		t.Fatalf("AddUser with taken name = %v, want ErrNameTaken", err)
+	}
+
+	// entries that older builds logged before the store checked them
+	for _, e := range []*walEntry{
+		{Op: walAddMessage, Message: &Message{ID: 12, ChannelID: 98, UserID: 1, CreatedAt: now}},
+		{Op: walEditMessage, Message: &Message{ID: 13, ChannelID: 97, UserID: 1, EditedAt: &now}},
+		{Op: walUpdateHaveRead, ChannelID: 96, UserID: 1, MessageID: 10},
+		{Op: walAddUser, User: &User{ID: 3, Name: "alice"}},
+	} {
+		if err := j.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ws.AddMessage(&Message{ID: 14, ChannelID: 1, UserID: 1, Content: "after", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	j2, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := newMemoryStore()
+	n, err := j2.Replay(ms)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("replayed %d entries, want 4", n)
+	}
+	for _, tt := range []struct {
+		id   int64
+		want bool
+	}{{10, true}, {11, false}, {12, false}, {13, false}, {14, true}} {
+		m, _ := ms.GetMessage(tt.id)
+		if (m != nil) != tt.want {
+			t.Errorf("message %d present = %v, want %v", tt.id, m != nil, tt.want)
+		}
+	}
+	if u, _ := ms.GetUserByName("alice"); u == nil || u.ID != 1 {
+		t.Errorf("alice = %+v, want user 1", u)
+	}
+}
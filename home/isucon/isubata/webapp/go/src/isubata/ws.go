@@ -0,0 +1,290 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = 25 * time.Second
+	wsMaxFrame     = 64 * 1024
+	wsSendBuffer   = 256
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsRequest is a command sent by the client. Ref is echoed back in the
+// reply so the client can match them up.
+type wsRequest struct {
+	Type          string `json:"type"`
+	Ref           string `json:"ref,omitempty"`
+	ChannelID     int64  `json:"channel_id"`
+	LastMessageID int64  `json:"last_message_id"`
+	MessageID     int64  `json:"message_id"`
+	ParentID      int64  `json:"parent_id"`
+	Content       string `json:"content"`
+}
+
+type wsConn struct {
+	conn   *websocket.Conn
+	sess   *sessionInfo
+	userID int64
+
+	send chan interface{}
+	done chan struct{}
+	once sync.Once
+
+	subs map[int64]chan struct{}
+	m    sync.Mutex
+}
+
+// getWebSocket serves /ws. One connection can follow several channels, post
+// messages, mark them read and receives unread counts as they change. A
+// client that does not keep up with its send buffer is disconnected, and so
+// is one whose session is revoked.
+func getWebSocket(c echo.Context) error {
+	sess := currentSession(c)
+	if sess == nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return nil
+	}
+
+	w := &wsConn{
+		conn:   conn,
+		sess:   sess,
+		userID: sess.UserID,
+		send:   make(chan interface{}, wsSendBuffer),
+		done:   make(chan struct{}),
+		subs:   make(map[int64]chan struct{}),
+	}
+	go w.writeLoop()
+	go w.unreadLoop()
+	w.readLoop()
+	return nil
+}
+
+func (w *wsConn) close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+// push queues v for the client and drops the connection if its buffer is full.
+func (w *wsConn) push(v interface{}) {
+	select {
+	case w.send <- v:
+	case <-w.done:
+	default:
+		log.Printf("ws: user %d is too slow, disconnecting", w.userID)
+		w.close()
+	}
+}
+
+func (w *wsConn) pushError(ref string, err error) {
+	w.push(map[string]interface{}{
+		"type":  "error",
+		"ref":   ref,
+		"error": err.Error(),
+	})
+}
+
+func (w *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	recheck := time.NewTicker(sessionRecheck)
+	defer recheck.Stop()
+	defer w.close()
+	for {
+		select {
+		case v := <-w.send:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteJSON(v); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-recheck.C:
+			if !sessionAlive(w.sess) {
+				msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+				w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *wsConn) readLoop() {
+	defer w.close()
+	w.conn.SetReadLimit(wsMaxFrame)
+	w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	w.conn.SetPongHandler(func(string) error {
+		return w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		req := wsRequest{}
+		if err := w.conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("ws: user %d: %v", w.userID, err)
+			}
+			return
+		}
+		w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		w.handle(&req)
+	}
+}
+
+func (w *wsConn) handle(req *wsRequest) {
+	switch req.Type {
+	case "ping":
+		w.push(map[string]interface{}{"type": "pong", "ref": req.Ref})
+	case "subscribe":
+		ch, err := store.GetChannel(req.ChannelID)
+		if err != nil {
+			w.pushError(req.Ref, err)
+			return
+		}
+		if ch == nil {
+			w.pushError(req.Ref, ErrChannelNotFound)
+			return
+		}
+		w.subscribe(req.ChannelID, req.LastMessageID)
+		w.push(map[string]interface{}{"type": "subscribed", "ref": req.Ref, "channel_id": req.ChannelID})
+	case "unsubscribe":
+		w.unsubscribe(req.ChannelID)
+		w.push(map[string]interface{}{"type": "unsubscribed", "ref": req.Ref, "channel_id": req.ChannelID})
+	case "post":
+		if req.Content == "" {
+			w.pushError(req.Ref, echo.ErrForbidden)
+			return
+		}
+		id, err := addMessage(req.ChannelID, w.userID, req.ParentID, req.Content)
+		if err != nil {
+			w.pushError(req.Ref, err)
+			return
+		}
+		w.push(map[string]interface{}{"type": "posted", "ref": req.Ref, "channel_id": req.ChannelID, "id": id})
+	case "read":
+		if err := store.UpdateHaveRead(req.ChannelID, w.userID, req.MessageID); err != nil {
+			w.pushError(req.Ref, err)
+			return
+		}
+		replicateHaveRead(req.ChannelID, w.userID, req.MessageID)
+		w.push(map[string]interface{}{
+			"type":       "read_ack",
+			"ref":        req.Ref,
+			"channel_id": req.ChannelID,
+			"message_id": req.MessageID,
+		})
+		unreadNotifier.Notify(w.userID)
+	default:
+		w.pushError(req.Ref, ErrBadReqeust)
+	}
+}
+
+func (w *wsConn) subscribe(chanID, lastID int64) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, ok := w.subs[chanID]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	w.subs[chanID] = stop
+	go w.channelLoop(chanID, lastID, stop)
+}
+
+func (w *wsConn) unsubscribe(chanID int64) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if stop, ok := w.subs[chanID]; ok {
+		close(stop)
+		delete(w.subs, chanID)
+	}
+}
+
+// channelLoop pushes the messages of a channel newer than lastID. The first
+// push is only the newest catchUpLimit of them, so subscribing to a busy
+// channel doesn't overflow the send buffer.
+func (w *wsConn) channelLoop(chanID, lastID int64, stop chan struct{}) {
+	limit := catchUpLimit
+	for {
+		wait := channelNotifier.Wait(chanID)
+		ms, err := store.GetMessagesAfter(chanID, lastID, limit, true)
+		limit = 0
+		if err != nil {
+			w.pushError("", err)
+			return
+		}
+		for _, m := range ms {
+			r, err := jsonifyMessage(m)
+			if err != nil {
+				w.pushError("", err)
+				return
+			}
+			w.push(map[string]interface{}{
+				"type":       "message",
+				"channel_id": chanID,
+				"message":    r,
+			})
+			lastID = m.ID
+		}
+
+		select {
+		case <-wait:
+		case <-stop:
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// unreadLoop pushes the counts fetchUnread would return whenever they change.
+func (w *wsConn) unreadLoop() {
+	var last map[int64]int64
+	for {
+		wait := unreadNotifier.Wait(w.userID)
+		resp, _, err := queryUnread(w.userID)
+		if err != nil {
+			w.pushError("", err)
+			return
+		}
+		cur := make(map[int64]int64, len(resp))
+		changed := last == nil || len(resp) != len(last)
+		for _, r := range resp {
+			id, _ := r["channel_id"].(int64)
+			cnt, _ := r["unread"].(int64)
+			cur[id] = cnt
+			if last[id] != cnt {
+				changed = true
+			}
+		}
+		if changed {
+			w.push(map[string]interface{}{"type": "unread", "channels": resp})
+			last = cur
+		}
+
+		select {
+		case <-wait:
+		case <-w.done:
+			return
+		}
+	}
+}